@@ -0,0 +1,310 @@
+package testdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RunCommand runs an arbitrary command, like collStats or dbHash, against the
+// TestDB's database and returns the raw result. It's an escape hatch for
+// anything the more specific helpers don't cover. Connect must be called first.
+func (t *TestDB) RunCommand(ctx context.Context, cmd interface{}) (bson.Raw, error) {
+	if t.client == nil {
+		return nil, errNotConnected
+	}
+	return t.client.Database(t.database()).RunCommand(ctx, cmd).Raw()
+}
+
+// RunAdminCommand is like RunCommand, but it runs the command against the admin
+// database. Use it for server-wide commands like serverStatus or fsync.
+func (t *TestDB) RunAdminCommand(ctx context.Context, cmd interface{}) (bson.Raw, error) {
+	if t.client == nil {
+		return nil, errNotConnected
+	}
+	return t.client.Database("admin").RunCommand(ctx, cmd).Raw()
+}
+
+// CollectionStats runs the collStats command on coll and returns its result,
+// which includes things like the document count, storage size, whether
+// the collection is capped, and the size of each index. Errors from the command
+// are returned as-is.
+func (t *TestDB) CollectionStats(ctx context.Context, coll *mongo.Collection) (bson.M, error) {
+	if t.client == nil {
+		return nil, errNotConnected
+	}
+
+	var stats bson.M
+	cmd := bson.D{{Key: "collStats", Value: coll.Name()}}
+	if err := coll.Database().RunCommand(ctx, cmd).Decode(&stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Compact runs the compact command on coll to reclaim the storage freed by
+// deleting documents, for tests of storage behavior. Compacting can block
+// other operations on the server, so only collections created by the TestDB
+// can be compacted. It isn't supported everywhere, e.g. not through mongos or
+// with the in-memory storage engine, and the returned error says so when the
+// server rejects the command for that reason.
+func (t *TestDB) Compact(ctx context.Context, coll *mongo.Collection) error {
+	if t.client == nil {
+		return errNotConnected
+	}
+	ns := coll.Database().Name() + "." + coll.Name()
+	if !t.tracked(coll) {
+		return fmt.Errorf("compacting %s: only collections created by the TestDB can be compacted", ns)
+	}
+
+	err := coll.Database().RunCommand(ctx, bson.D{{Key: "compact", Value: coll.Name()}}).Err()
+	var ce mongo.CommandError
+	if errors.As(err, &ce) && (ce.Code == commandNotFoundCode || ce.Code == commandNotSupportedCode) {
+		return fmt.Errorf("compacting %s: compact isn't supported by this deployment: %w", ns, err)
+	}
+	if err != nil {
+		return fmt.Errorf("compacting %s: %w", ns, err)
+	}
+	return nil
+}
+
+// The topologies returned by Topology.
+const (
+	TopologyStandalone = "standalone"
+	TopologyReplicaSet = "replicaset"
+	TopologySharded    = "sharded"
+)
+
+// Topology reports how the MongoDB deployment the TestDB is connected to is
+// laid out: TopologyStandalone, TopologyReplicaSet, or TopologySharded. Tests
+// can use it to decide what they're able to exercise, since features like
+// transactions and change streams aren't available everywhere.
+func (t *TestDB) Topology(ctx context.Context) (string, error) {
+	hello, err := t.hello(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	// mongos identifies itself with msg: "isdbgrid", and replica set members
+	// report the name of their set.
+	if msg, _ := hello.Lookup("msg").StringValueOK(); msg == "isdbgrid" {
+		return TopologySharded, nil
+	}
+	if _, ok := hello.Lookup("setName").StringValueOK(); ok {
+		return TopologyReplicaSet, nil
+	}
+	return TopologyStandalone, nil
+}
+
+// OplogEntries returns the entries in the replica set's oplog newer than
+// since, oldest first, so tests can check which writes an operation produced,
+// e.g. for change data capture. since is usually the operationTime of an
+// earlier command, or the zero Timestamp for the whole oplog. The oplog only
+// exists on replica set members, so an error is returned for any other
+// topology.
+func (t *TestDB) OplogEntries(ctx context.Context, since primitive.Timestamp) ([]bson.M, error) {
+	topology, err := t.Topology(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if topology != TopologyReplicaSet {
+		return nil, fmt.Errorf("reading the oplog requires a replica set, but the server is %s", topology)
+	}
+
+	oplog := t.client.Database("local").Collection("oplog.rs")
+	filter := bson.M{"ts": bson.M{"$gt": since}}
+	opts := options.Find().SetSort(bson.D{{Key: "$natural", Value: 1}})
+
+	var entries []bson.M
+	if err := FindAll(ctx, oplog, filter, &entries, opts); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// ServerTime returns the current time according to the MongoDB server, with
+// millisecond precision. Tests of TTL indexes and other time-based behavior can
+// compare against it instead of the local clock, which may be skewed from the
+// server's.
+func (t *TestDB) ServerTime(ctx context.Context) (time.Time, error) {
+	hello, err := t.hello(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	localTime, ok := hello.Lookup("localTime").DateTimeOK()
+	if !ok {
+		return time.Time{}, fmt.Errorf("server did not report its localTime")
+	}
+	return time.UnixMilli(localTime), nil
+}
+
+// PrimaryHost returns the address, as host:port, of the primary the TestDB is
+// talking to. It's meant for logging which node a test actually hit, e.g. in
+// replica set CI. For a standalone server with a single host in the URL, that
+// host is returned. An error is returned if no primary is known, like during an
+// election.
+func (t *TestDB) PrimaryHost(ctx context.Context) (string, error) {
+	hello, err := t.hello(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	// Replica set members report the current primary. Standalone servers
+	// don't report their own address, so fall back to the one connected to.
+	if primary, ok := hello.Lookup("primary").StringValueOK(); ok && primary != "" {
+		return primary, nil
+	}
+	writable, ok := hello.Lookup("isWritablePrimary").BooleanOK()
+	if !ok {
+		writable, _ = hello.Lookup("ismaster").BooleanOK()
+	}
+	if _, isRS := hello.Lookup("setName").StringValueOK(); writable && !isRS {
+		if hosts := t.ClientOptions().Hosts; len(hosts) == 1 {
+			return hosts[0], nil
+		}
+	}
+	return "", errors.New("no primary is known")
+}
+
+// Sleep runs the server's sleep command, which occupies a connection on the
+// server for d without taking any locks, so tests can check how their code
+// handles slow operations, e.g. that a context deadline or MaxTimeMSExpired is
+// handled. If ctx expires first, the driver's timeout error is returned.
+//
+// The sleep command only exists on servers started with
+// --setParameter enableTestCommands=1, so Sleep can't slow down a production
+// deployment by mistake. Against any other server it returns an error saying
+// so.
+func (t *TestDB) Sleep(ctx context.Context, d time.Duration) error {
+	_, err := t.RunAdminCommand(ctx, bson.D{
+		{Key: "sleep", Value: 1},
+		{Key: "millis", Value: d.Milliseconds()},
+		{Key: "lock", Value: "none"},
+	})
+	var ce mongo.CommandError
+	if errors.As(err, &ce) && ce.Code == commandNotFoundCode {
+		return fmt.Errorf("sleep requires a server started with enableTestCommands=1: %w", err)
+	}
+	return err
+}
+
+// ServerVersion returns the version of the MongoDB server, like "7.0.2".
+func (t *TestDB) ServerVersion(ctx context.Context) (string, error) {
+	res, err := t.RunAdminCommand(ctx, bson.D{{Key: "buildInfo", Value: 1}})
+	if err != nil {
+		return "", err
+	}
+	version, ok := res.Lookup("version").StringValueOK()
+	if !ok {
+		return "", fmt.Errorf("server did not report its version")
+	}
+	return version, nil
+}
+
+// checkServerVersion returns an error if the server is older than minVersion,
+// which is a *serverTooOldError, or the driver's error if its version can't be
+// found.
+func (t *TestDB) checkServerVersion(ctx context.Context, minVersion string) error {
+	if _, err := parseVersion(minVersion); err != nil {
+		return err
+	}
+
+	version, err := t.ServerVersion(ctx)
+	if err != nil {
+		return err
+	}
+	return versionAtLeast(version, minVersion)
+}
+
+// versionAtLeast returns a *serverTooOldError if version is older than
+// minVersion.
+func versionAtLeast(version, minVersion string) error {
+	want, err := parseVersion(minVersion)
+	if err != nil {
+		return err
+	}
+	got, err := parseVersion(version)
+	if err != nil {
+		return err
+	}
+
+	if compareVersions(got, want) < 0 {
+		return &serverTooOldError{version: version, minVersion: minVersion}
+	}
+	return nil
+}
+
+// A serverTooOldError is returned by checkServerVersion and versionAtLeast when
+// the server is older than the version required.
+type serverTooOldError struct {
+	version    string
+	minVersion string
+}
+
+func (e *serverTooOldError) Error() string {
+	return fmt.Sprintf("server version %s is older than the minimum required version %s", e.version, e.minVersion)
+}
+
+const (
+	commandNotFoundCode     = 59
+	commandNotSupportedCode = 115
+)
+
+// hello runs the hello command, falling back to its legacy name, isMaster, on
+// servers too old to know it.
+func (t *TestDB) hello(ctx context.Context) (bson.Raw, error) {
+	res, err := t.RunAdminCommand(ctx, bson.D{{Key: "hello", Value: 1}})
+	var ce mongo.CommandError
+	if errors.As(err, &ce) && ce.Code == commandNotFoundCode {
+		return t.RunAdminCommand(ctx, bson.D{{Key: "isMaster", Value: 1}})
+	}
+	return res, err
+}
+
+// parseVersion parses the numeric parts of a dotted version string. Anything
+// after the numbers, like the "-rc1" in "7.0.0-rc1", is ignored.
+func parseVersion(v string) ([]int, error) {
+	if i := strings.IndexFunc(v, func(r rune) bool { return r != '.' && (r < '0' || r > '9') }); i >= 0 {
+		v = v[:i]
+	}
+
+	var parts []int
+	for _, p := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q", v)
+		}
+		parts = append(parts, n)
+	}
+	return parts, nil
+}
+
+// compareVersions returns -1, 0, or 1 if a is older than, the same as, or newer
+// than b. Missing parts count as 0, so "4.4" and "4.4.0" are the same.
+func compareVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x < y {
+			return -1
+		}
+		if x > y {
+			return 1
+		}
+	}
+	return 0
+}
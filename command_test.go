@@ -0,0 +1,240 @@
+package testdb_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mongo-go/testdb"
+)
+
+func TestRunCommand(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+
+	// RunCommand errors if called before Connect.
+	if _, err := testDb.RunCommand(context.Background(), bson.D{{Key: "ping", Value: 1}}); err == nil {
+		t.Fatal("expected an error, did not get one")
+	}
+
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	res, err := testDb.RunCommand(context.Background(), bson.D{{Key: "dbStats", Value: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db, _ := res.Lookup("db").StringValueOK(); db != defaultDb {
+		t.Errorf("got db %q, expected %q", db, defaultDb)
+	}
+
+	res, err = testDb.RunAdminCommand(context.Background(), bson.D{{Key: "serverStatus", Value: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := res.LookupErr("uptime"); err != nil {
+		t.Errorf("expected serverStatus to include uptime (err: %s)", err)
+	}
+}
+
+func TestTopology(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	topology, err := testDb.Topology(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch topology {
+	case testdb.TopologyStandalone, testdb.TopologyReplicaSet, testdb.TopologySharded:
+	default:
+		t.Errorf("got unexpected topology %q", topology)
+	}
+}
+
+func TestPrimaryHost(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	host, err := testDb.PrimaryHost(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host == "" {
+		t.Error("got an empty primary host")
+	}
+}
+
+func TestSleep(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err := testDb.Sleep(ctx, time.Second)
+	if err != nil && strings.Contains(err.Error(), "enableTestCommands") {
+		t.Skip(err)
+	}
+	if !mongo.IsTimeout(err) {
+		t.Errorf("expected a timeout error, got %v", err)
+	}
+}
+
+func TestOplogEntries(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	topology, err := testDb.Topology(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topology != testdb.TopologyReplicaSet {
+		if _, err := testDb.OplogEntries(context.Background(), primitive.Timestamp{}); err == nil {
+			t.Errorf("expected an error on a %s server, did not get one", topology)
+		}
+		t.Skipf("the oplog requires a replica set, but the server is %s", topology)
+	}
+
+	coll, err := testDb.CreateRandomCollection(testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	// Collect entries from after the server's current time.
+	res, err := testDb.RunCommand(context.Background(), bson.D{{Key: "ping", Value: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec, inc := res.Lookup("operationTime").Timestamp()
+	since := primitive.Timestamp{T: sec, I: inc}
+
+	if _, err := coll.InsertOne(context.Background(), bson.M{"_id": "oplog-test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := testDb.OplogEntries(context.Background(), since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := coll.Database().Name() + "." + coll.Name()
+	found := false
+	for _, e := range entries {
+		if e["op"] == "i" && e["ns"] == ns {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected an insert into %s in the oplog, got %v", ns, entries)
+	}
+}
+
+func TestServerTime(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	serverTime, err := testDb.ServerTime(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The test server runs locally, so its clock should be close to ours.
+	if skew := time.Since(serverTime); skew > time.Minute || skew < -time.Minute {
+		t.Errorf("got server time %s, which is %s off from the local clock", serverTime, skew)
+	}
+}
+
+func TestMinServerVersion(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	testDb.SetMinServerVersion("3.0")
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	testDb.Close()
+
+	testDb = testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	testDb.SetMinServerVersion("999.0")
+	if err := testDb.Connect(); err == nil {
+		testDb.Close()
+		t.Fatal("expected an error, did not get one")
+	}
+}
+
+func TestCollectionStats(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, err := testDb.CreateRandomCollection(testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	if _, err := testDb.Seed(context.Background(), coll, bson.M{"a": 1}, bson.M{"a": 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := testDb.CollectionStats(context.Background(), coll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, ok := stats["count"].(int32); !ok || count != 2 {
+		t.Errorf("got count %v, expected 2", stats["count"])
+	}
+}
+
+func TestCompact(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, err := testDb.CreateRandomCollection(testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+	if _, err := testDb.Seed(context.Background(), coll, bson.M{"a": 1}, bson.M{"a": 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	err = testDb.Compact(context.Background(), coll)
+	if err != nil && strings.Contains(err.Error(), "isn't supported") {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Collections the TestDB didn't create can't be compacted.
+	other := coll.Database().Collection("not_a_test_collection")
+	if err := testDb.Compact(context.Background(), other); err == nil {
+		t.Error("expected an error compacting a collection the TestDB didn't create, did not get one")
+	}
+}
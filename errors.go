@@ -0,0 +1,209 @@
+package testdb
+
+import (
+	"errors"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/auth"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+var (
+	// ErrInvalidURI is returned, wrapping the driver's error, by Connect and
+	// ValidateURI when the TestDB's url isn't a valid connection string.
+	ErrInvalidURI = errors.New("invalid MongoDB URI")
+
+	// ErrConnect is returned, wrapping the driver's error, by Connect when the
+	// url is valid but the client can't be started or the server can't be
+	// reached. Connect only talks to the server when it has to, e.g. to check
+	// SetMinServerVersion, so an unreachable server usually isn't noticed
+	// until the first operation.
+	ErrConnect = errors.New("cannot connect to MongoDB")
+)
+
+const dupeKeyCode = 11000
+
+// IsDupeKeyError returns true if the error is a Mongo duplicate key error.
+func IsDupeKeyError(err error) bool {
+	// mongo.WriteException{
+	//   WriteConcernError:(*mongo.WriteConcernError)(nil),
+	//   WriteErrors:mongo.WriteErrors{
+	//     mongo.WriteError{
+	//       Index:0,
+	//       Code:11000,
+	//       Message:"E11000 duplicate key error collection: coll.nodes index: x_1 dup key: { : 6 }"
+	//     }
+	//   }
+	// }
+	//
+	// The driver returns some of these by value and others by pointer, and
+	// callers may wrap either, so look for anything in the chain that's a
+	// mongo.ServerError and then check both forms.
+	var se mongo.ServerError
+	if !errors.As(err, &se) {
+		return false
+	}
+	switch e := se.(type) {
+	case mongo.WriteException:
+		return hasWriteErrorCode(e.WriteErrors, dupeKeyCode)
+	case *mongo.WriteException:
+		return e != nil && hasWriteErrorCode(e.WriteErrors, dupeKeyCode)
+	case mongo.BulkWriteException:
+		return hasBulkWriteErrorCode(e.WriteErrors, dupeKeyCode)
+	case *mongo.BulkWriteException:
+		return e != nil && hasBulkWriteErrorCode(e.WriteErrors, dupeKeyCode)
+	case mongo.CommandError:
+		return e.Code == dupeKeyCode
+	case *mongo.CommandError:
+		return e != nil && e.Code == dupeKeyCode
+	}
+	return false
+}
+
+func hasWriteErrorCode(errs mongo.WriteErrors, code int) bool {
+	for _, e := range errs {
+		if e.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func hasBulkWriteErrorCode(errs []mongo.BulkWriteError, code int) bool {
+	for _, e := range errs {
+		if e.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// AsCommandError finds the first mongo.CommandError in err's chain, whether
+// it's there by value or by pointer, so tests can inspect its Code, Name, and
+// Message even when the error has been wrapped.
+func AsCommandError(err error) (*mongo.CommandError, bool) {
+	var ce mongo.CommandError
+	if errors.As(err, &ce) {
+		return &ce, true
+	}
+	var cep *mongo.CommandError
+	if errors.As(err, &cep) && cep != nil {
+		return cep, true
+	}
+	return nil, false
+}
+
+const documentValidationFailureCode = 121
+
+// IsValidationError returns true if the error is caused by a document failing
+// its collection's validator, like one set up by
+// CreateRandomCollectionWithValidator.
+func IsValidationError(err error) bool {
+	var se mongo.ServerError
+	return errors.As(err, &se) && se.HasErrorCode(documentValidationFailureCode)
+}
+
+const namespaceNotFoundCode = 26
+
+// isNamespaceNotFound returns true if the error is because a collection or
+// database doesn't exist.
+func isNamespaceNotFound(err error) bool {
+	var se mongo.ServerError
+	return errors.As(err, &se) && se.HasErrorCode(namespaceNotFoundCode)
+}
+
+// transientCodes are the codes of server errors that a drop can fail with
+// transiently, mostly on sharded clusters or during elections.
+var transientCodes = []int{
+	24,    // LockTimeout
+	46,    // LockBusy
+	117,   // ConflictingOperationInProgress
+	10107, // NotWritablePrimary
+	11600, // InterruptedAtShutdown
+	11602, // InterruptedDueToReplStateChange
+	13388, // StaleConfig
+	13435, // NotPrimaryNoSecondaryOk
+}
+
+// isTransient returns true if the error looks like one that retrying the same
+// operation can succeed after: one the driver labeled as retryable, a
+// connection failure, or a server error with one of transientCodes.
+func isTransient(err error) bool {
+	if IsRetryable(err) || IsConnectionError(err) {
+		return true
+	}
+	var se mongo.ServerError
+	if !errors.As(err, &se) {
+		return false
+	}
+	for _, code := range transientCodes {
+		if se.HasErrorCode(code) {
+			return true
+		}
+	}
+	return false
+}
+
+const authFailedCode = 18
+
+// IsConnectionError returns true if the error means MongoDB couldn't be
+// reached: a network failure, a connection that couldn't be established, or a
+// server that couldn't be selected in time. Authentication failures aren't
+// considered connection errors; use IsAuthError for those.
+//
+// Connect doesn't do any I/O, so these errors surface from the first operation
+// run against the TestDB.
+func IsConnectionError(err error) bool {
+	if err == nil || IsAuthError(err) {
+		return false
+	}
+	if mongo.IsNetworkError(err) {
+		return true
+	}
+	var sse topology.ServerSelectionError
+	if errors.As(err, &sse) {
+		return true
+	}
+	var ce topology.ConnectionError
+	return errors.As(err, &ce)
+}
+
+// IsRetryable returns true if the driver labeled the error as transient, i.e.
+// with the RetryableWriteError or TransientTransactionError label, meaning the
+// operation or transaction can safely be retried. Failover tests can use it to
+// check that an error seen while a primary steps down is one the driver, or
+// the application, is expected to retry.
+func IsRetryable(err error) bool {
+	var le mongo.LabeledError
+	if !errors.As(err, &le) {
+		return false
+	}
+	return le.HasErrorLabel("RetryableWriteError") || le.HasErrorLabel("TransientTransactionError")
+}
+
+// IsAuthError returns true if the error is caused by MongoDB rejecting the
+// credentials used to connect to it.
+func IsAuthError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var ae *auth.Error
+	if errors.As(err, &ae) {
+		return true
+	}
+
+	// When every server fails authentication, the driver reports a server
+	// selection error and the auth error is only recorded in the topology.
+	var sse topology.ServerSelectionError
+	if errors.As(err, &sse) {
+		for _, s := range sse.Desc.Servers {
+			if errors.As(s.LastError, &ae) {
+				return true
+			}
+		}
+	}
+
+	var se mongo.ServerError
+	return errors.As(err, &se) && se.HasErrorCode(authFailedCode)
+}
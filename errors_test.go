@@ -0,0 +1,157 @@
+package testdb_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/description"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+
+	"github.com/mongo-go/testdb"
+)
+
+func TestIsDupeKeyError(t *testing.T) {
+	writeErrors := mongo.WriteErrors{
+		{Code: 11000, Message: "E11000 duplicate key error"},
+	}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"other", errors.New("boom"), false},
+		{"write exception", mongo.WriteException{WriteErrors: writeErrors}, true},
+		{"write exception pointer", &mongo.WriteException{WriteErrors: writeErrors}, true},
+		{"wrapped write exception pointer", fmt.Errorf("inserting: %w", &mongo.WriteException{WriteErrors: writeErrors}), true},
+		{"nil write exception pointer", (*mongo.WriteException)(nil), false},
+		{"bulk write exception", mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{{WriteError: writeErrors[0]}}}, true},
+		{"command error", mongo.CommandError{Code: 11000}, true},
+		{"command error pointer", &mongo.CommandError{Code: 11000}, true},
+		{"other command error", mongo.CommandError{Code: 121}, false},
+	}
+	for _, tc := range tests {
+		if got := testdb.IsDupeKeyError(tc.err); got != tc.want {
+			t.Errorf("%s: got %t, expected %t", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestAsCommandError(t *testing.T) {
+	cmdErr := mongo.CommandError{Code: 59, Name: "CommandNotFound", Message: "no such command"}
+	for _, err := range []error{
+		cmdErr,
+		&cmdErr,
+		fmt.Errorf("running command: %w", cmdErr),
+		fmt.Errorf("running command: %w", &cmdErr),
+	} {
+		ce, ok := testdb.AsCommandError(err)
+		if !ok {
+			t.Errorf("%#v: expected a command error, did not get one", err)
+			continue
+		}
+		if ce.Code != 59 || ce.Name != "CommandNotFound" {
+			t.Errorf("%#v: got code %d and name %q, expected 59 and CommandNotFound", err, ce.Code, ce.Name)
+		}
+	}
+
+	for _, err := range []error{nil, errors.New("boom"), mongo.WriteException{}} {
+		if _, ok := testdb.AsCommandError(err); ok {
+			t.Errorf("%#v: expected not to get a command error", err)
+		}
+	}
+}
+
+func TestIsConnectionError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"other", errors.New("boom"), false},
+		{"connection", topology.ConnectionError{Wrapped: errors.New("connection refused")}, true},
+		{"server selection", topology.ServerSelectionError{Desc: description.Topology{}}, true},
+		{"auth failed", mongo.CommandError{Code: 18, Name: "AuthenticationFailed"}, false},
+	}
+	for _, tc := range tests {
+		if got := testdb.IsConnectionError(tc.err); got != tc.want {
+			t.Errorf("%s: got %t, expected %t", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestIsValidationError(t *testing.T) {
+	validationErr := mongo.WriteException{
+		WriteErrors: mongo.WriteErrors{
+			{Code: 121, Message: "Document failed validation"},
+		},
+	}
+	if !testdb.IsValidationError(validationErr) {
+		t.Error("expected a validation error, did not get one")
+	}
+
+	dupeErr := mongo.WriteException{
+		WriteErrors: mongo.WriteErrors{
+			{Code: 11000, Message: "E11000 duplicate key error"},
+		},
+	}
+	if testdb.IsValidationError(dupeErr) {
+		t.Error("expected a duplicate key error not to be a validation error")
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		expect bool
+	}{
+		{"retryable write", mongo.CommandError{Code: 91, Labels: []string{"RetryableWriteError"}}, true},
+		{"transient transaction", mongo.WriteException{Labels: []string{"TransientTransactionError"}}, true},
+		{"wrapped", fmt.Errorf("inserting: %w", mongo.CommandError{Labels: []string{"RetryableWriteError"}}), true},
+		{"other label", mongo.CommandError{Code: 11000, Labels: []string{"NoWritesPerformed"}}, false},
+		{"unlabeled", errors.New("boom"), false},
+		{"nil", nil, false},
+	}
+	for _, tc := range tests {
+		if got := testdb.IsRetryable(tc.err); got != tc.expect {
+			t.Errorf("%s: got %t, expected %t", tc.name, got, tc.expect)
+		}
+	}
+}
+
+func TestIsAuthError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"other", errors.New("boom"), false},
+		{"connection", topology.ConnectionError{Wrapped: errors.New("connection refused")}, false},
+		{"auth failed", mongo.CommandError{Code: 18, Name: "AuthenticationFailed"}, true},
+	}
+	for _, tc := range tests {
+		if got := testdb.IsAuthError(tc.err); got != tc.want {
+			t.Errorf("%s: got %t, expected %t", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestUnreachableIsConnectionError(t *testing.T) {
+	testDb := testdb.NewTestDB("mongodb://localhost:1", "test", defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	_, err := testDb.RunCommand(context.Background(), bson.D{{Key: "ping", Value: 1}})
+	if !testdb.IsConnectionError(err) {
+		t.Errorf("expected a connection error, got %v", err)
+	}
+}
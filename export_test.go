@@ -0,0 +1,40 @@
+package testdb
+
+import (
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// SetRandSeq makes fn generate the random part of names until tb finishes.
+func SetRandSeq(tb testing.TB, fn func(alphabet []rune, n int) string) {
+	old := randSeqFunc
+	randSeqFunc = fn
+	tb.Cleanup(func() { randSeqFunc = old })
+}
+
+// CurrentDatabase returns the name of the database the TestDB is using.
+func (t *TestDB) CurrentDatabase() string {
+	return t.database()
+}
+
+// RetryDrop calls drop the way the TestDB's drops are retried.
+func (t *TestDB) RetryDrop(ctx context.Context, drop func(context.Context) error) error {
+	return t.retryDrop(ctx, drop)
+}
+
+// WinningPlanStages returns the stages of each winning plan in an explain
+// result's queryPlanner, keyed by shard name, which is empty if the collection
+// isn't sharded.
+func WinningPlanStages(planner bson.M) (map[string][]string, error) {
+	plans, err := winningPlanStages(planner)
+	if err != nil {
+		return nil, err
+	}
+	stages := map[string][]string{}
+	for _, p := range plans {
+		stages[p.shard] = p.stages
+	}
+	return stages, nil
+}
@@ -0,0 +1,328 @@
+package testdb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// defaultIndexBuildMaxTime is how long the server is allowed to spend building
+// indexes unless SetIndexBuildMaxTime says otherwise.
+const defaultIndexBuildMaxTime = 2 * time.Second
+
+// SetIndexBuildMaxTime sets how long the server may spend building the indexes
+// passed to CreateRandomCollection and EnsureIndexes before giving up. The
+// default is 2 seconds, which is plenty for empty collections but can be too
+// short when building indexes over a lot of seeded data. Zero means no limit.
+func (t *TestDB) SetIndexBuildMaxTime(d time.Duration) {
+	t.indexBuildMaxTime = d
+}
+
+// EnsureIndexes creates the provided indexes on coll. It's what
+// CreateRandomCollection uses to set up indexes, and it can also be used to add
+// indexes to a collection that already exists. Creating an index that already
+// exists with the same options is a no-op.
+func (t *TestDB) EnsureIndexes(ctx context.Context, coll *mongo.Collection, indexes []mongo.IndexModel) error {
+	if len(indexes) == 0 {
+		return nil
+	}
+
+	opts := options.CreateIndexes()
+	if t.indexBuildMaxTime > 0 {
+		opts.SetMaxTime(t.indexBuildMaxTime)
+	}
+	names, err := coll.Indexes().CreateMany(ctx, indexes, opts)
+	if err != nil {
+		return err
+	}
+	if t.verifyIndexes {
+		return verifyIndexes(ctx, coll, indexes, names)
+	}
+	return nil
+}
+
+// SetVerifyIndexes makes CreateRandomCollection and EnsureIndexes check that
+// every index they create exists afterwards with the requested name, keys, and
+// unique flag, returning an error if not. This catches the server silently
+// ignoring or altering an index. It's off by default because it costs an extra
+// round trip per call.
+func (t *TestDB) SetVerifyIndexes(enabled bool) {
+	t.verifyIndexes = enabled
+}
+
+// CreateRandomCollectionLike is like CreateRandomCollection, but it creates the
+// new collection with the same indexes as src, other than the default _id
+// index. It's a quick way to set up collections for parallel tests that must
+// match an existing schema. Index names, keys, and the unique, sparse, TTL,
+// partial filter, and text index options are copied; other options, like
+// collations, aren't.
+func (t *TestDB) CreateRandomCollectionLike(ctx context.Context, src *mongo.Collection) (*mongo.Collection, error) {
+	indexes, err := indexModels(ctx, src)
+	if err != nil {
+		return nil, fmt.Errorf("reading indexes of %s.%s: %w", src.Database().Name(), src.Name(), err)
+	}
+	return t.createRandomCollection(ctx, nil, "", indexes)
+}
+
+// indexSpec is the part of a listIndexes result that CreateRandomCollectionLike
+// copies.
+type indexSpec struct {
+	Name                    string `bson:"name"`
+	Key                     bson.D `bson:"key"`
+	Unique                  bool   `bson:"unique"`
+	Sparse                  bool   `bson:"sparse"`
+	ExpireAfterSeconds      *int32 `bson:"expireAfterSeconds"`
+	PartialFilterExpression bson.D `bson:"partialFilterExpression"`
+	Weights                 bson.D `bson:"weights"`
+	DefaultLanguage         string `bson:"default_language"`
+}
+
+// indexModels returns models for recreating the indexes on coll, other than the
+// _id index.
+func indexModels(ctx context.Context, coll *mongo.Collection) ([]mongo.IndexModel, error) {
+	cur, err := coll.Indexes().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var specs []indexSpec
+	if err := cur.All(ctx, &specs); err != nil {
+		return nil, err
+	}
+
+	var models []mongo.IndexModel
+	for _, spec := range specs {
+		if spec.Name == idIndexName {
+			continue
+		}
+
+		opts := options.Index().SetName(spec.Name)
+		if spec.Unique {
+			opts.SetUnique(true)
+		}
+		if spec.Sparse {
+			opts.SetSparse(true)
+		}
+		if spec.ExpireAfterSeconds != nil {
+			opts.SetExpireAfterSeconds(*spec.ExpireAfterSeconds)
+		}
+		if spec.PartialFilterExpression != nil {
+			opts.SetPartialFilterExpression(spec.PartialFilterExpression)
+		}
+
+		// Text indexes are listed with internal _fts and _ftsx keys in place
+		// of the indexed fields, which are listed in weights instead.
+		keys := make(bson.D, 0, len(spec.Key))
+		for _, k := range spec.Key {
+			switch k.Key {
+			case "_fts":
+				for _, w := range spec.Weights {
+					keys = append(keys, bson.E{Key: w.Key, Value: "text"})
+				}
+				opts.SetWeights(spec.Weights)
+				if spec.DefaultLanguage != "" {
+					opts.SetDefaultLanguage(spec.DefaultLanguage)
+				}
+			case "_ftsx":
+			default:
+				keys = append(keys, k)
+			}
+		}
+		models = append(models, mongo.IndexModel{Keys: keys, Options: opts})
+	}
+	return models, nil
+}
+
+// verifyIndexes checks that the indexes on coll match indexes, which were
+// created with the given names.
+func verifyIndexes(ctx context.Context, coll *mongo.Collection, indexes []mongo.IndexModel, names []string) error {
+	specs, err := coll.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return fmt.Errorf("listing indexes to verify them: %w", err)
+	}
+	byName := make(map[string]*mongo.IndexSpecification, len(specs))
+	for _, spec := range specs {
+		byName[spec.Name] = spec
+	}
+
+	ns := coll.Database().Name() + "." + coll.Name()
+	for i, idx := range indexes {
+		if i >= len(names) {
+			break
+		}
+		spec, ok := byName[names[i]]
+		if !ok {
+			return fmt.Errorf("index %s on %s was not created", names[i], ns)
+		}
+
+		wantUnique := idx.Options != nil && idx.Options.Unique != nil && *idx.Options.Unique
+		gotUnique := spec.Unique != nil && *spec.Unique
+		if wantUnique != gotUnique {
+			return fmt.Errorf("index %s on %s has unique=%t, expected %t", names[i], ns, gotUnique, wantUnique)
+		}
+
+		match, err := keysMatch(idx.Keys, spec.KeysDocument)
+		if err != nil {
+			return fmt.Errorf("verifying index %s on %s: %w", names[i], ns, err)
+		}
+		if !match {
+			return fmt.Errorf("index %s on %s has keys %s, expected %v", names[i], ns, spec.KeysDocument, idx.Keys)
+		}
+	}
+	return nil
+}
+
+// keysMatch reports whether the requested index keys match the keys the server
+// reports. Numeric directions are compared by value since the server may store
+// 1 as a double. Text indexes are stored as internal _fts/_ftsx keys, so they
+// aren't compared.
+func keysMatch(want interface{}, got bson.Raw) (bool, error) {
+	raw, err := bson.Marshal(want)
+	if err != nil {
+		return false, err
+	}
+	wantElems, err := bson.Raw(raw).Elements()
+	if err != nil {
+		return false, err
+	}
+	for _, e := range wantElems {
+		if s, ok := e.Value().StringValueOK(); ok && s == "text" {
+			return true, nil
+		}
+	}
+
+	gotElems, err := got.Elements()
+	if err != nil {
+		return false, err
+	}
+	if len(wantElems) != len(gotElems) {
+		return false, nil
+	}
+	for i := range wantElems {
+		if wantElems[i].Key() != gotElems[i].Key() {
+			return false, nil
+		}
+		wv, gv := wantElems[i].Value(), gotElems[i].Value()
+		wn, wok := numberValue(wv)
+		gn, gok := numberValue(gv)
+		switch {
+		case wok && gok:
+			if wn != gn {
+				return false, nil
+			}
+		case !bytes.Equal(wv.Value, gv.Value) || wv.Type != gv.Type:
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// GeoIndex returns a 2dsphere index on field, which should hold GeoJSON
+// objects. It's needed for $near and $nearSphere queries, and speeds up other
+// geospatial queries like $geoWithin.
+func GeoIndex(field string) mongo.IndexModel {
+	return mongo.IndexModel{
+		Keys: bson.D{{Key: field, Value: "2dsphere"}},
+	}
+}
+
+// TextIndex returns a text index over fields, which is needed for $text
+// queries. A collection can only have one text index, so all of the fields to
+// search should be passed in one call.
+func TextIndex(fields ...string) mongo.IndexModel {
+	keys := make(bson.D, len(fields))
+	for i, f := range fields {
+		keys[i] = bson.E{Key: f, Value: "text"}
+	}
+	return mongo.IndexModel{Keys: keys}
+}
+
+// NamedIndex returns an index on keys named name instead of the server's
+// default, which is built from the keys, e.g. "a_1_b_-1". It's for tests that
+// refer to indexes by name, like ones that drop or hint a specific index.
+func NamedIndex(name string, keys bson.D) mongo.IndexModel {
+	return mongo.IndexModel{
+		Keys:    keys,
+		Options: options.Index().SetName(name),
+	}
+}
+
+// clusteredIndexMinVersion is the first server version that supports creating
+// clustered collections.
+const clusteredIndexMinVersion = "5.3"
+
+// ClusteredIndex returns the clustered index spec for a collection clustered by
+// _id, which is the only key a clustered index can have. Pass it to
+// options.CreateCollection().SetClusteredIndex and
+// CreateRandomCollectionWithOptions to create a clustered collection.
+func ClusteredIndex() bson.D {
+	return bson.D{
+		{Key: "key", Value: bson.D{{Key: "_id", Value: 1}}},
+		{Key: "unique", Value: true},
+	}
+}
+
+// idIndexName is the name of the index every collection has on _id.
+const idIndexName = "_id_"
+
+// IndexNames returns the names of the indexes on coll, sorted. The default _id
+// index, "_id_", is only included if includeID is true, so tests can assert
+// that a collection has exactly the indexes they created by passing false.
+func IndexNames(ctx context.Context, coll *mongo.Collection, includeID bool) ([]string, error) {
+	specs, err := coll.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(specs))
+	for _, spec := range specs {
+		if spec.Name == idIndexName && !includeID {
+			continue
+		}
+		names = append(names, spec.Name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// HasIndex returns true if coll has an index called name, like one created with
+// NamedIndex. The driver's error is returned as-is.
+func HasIndex(ctx context.Context, coll *mongo.Collection, name string) (bool, error) {
+	names, err := IndexNames(ctx, coll, true)
+	if err != nil {
+		return false, err
+	}
+	for _, n := range names {
+		if n == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// DropIndexes drops every index on coll except the default _id index, e.g. to
+// reset a collection's indexes between subtests without dropping its data.
+// Connect must be called first. The driver's error is returned as-is.
+func (t *TestDB) DropIndexes(ctx context.Context, coll *mongo.Collection) error {
+	if t.client == nil {
+		return errNotConnected
+	}
+	_, err := coll.Indexes().DropAll(ctx)
+	return err
+}
+
+// numberValue returns v as a float64 if it's any BSON number type.
+func numberValue(v bson.RawValue) (float64, bool) {
+	if n, ok := v.Int32OK(); ok {
+		return float64(n), true
+	}
+	if n, ok := v.Int64OK(); ok {
+		return float64(n), true
+	}
+	return v.DoubleOK()
+}
@@ -0,0 +1,319 @@
+package testdb_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mongo-go/testdb"
+)
+
+func TestEnsureIndexes(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, err := testDb.CreateRandomCollection(testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "iamunique", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	}
+	if err := testDb.EnsureIndexes(context.Background(), coll, indexes); err != nil {
+		t.Fatal(err)
+	}
+
+	doc := bson.M{"iamunique": "a"}
+	if _, err := coll.InsertOne(context.Background(), doc); err != nil {
+		t.Fatal(err)
+	}
+	_, err = coll.InsertOne(context.Background(), doc)
+	if !testdb.IsDupeKeyError(err) {
+		t.Errorf("expected a duplicate key error, did not get one (err: %s)", err)
+	}
+}
+
+func TestGeoIndex(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, err := testDb.CreateRandomCollection([]mongo.IndexModel{testdb.GeoIndex("location")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	point := func(lng, lat float64) bson.M {
+		return bson.M{"type": "Point", "coordinates": []float64{lng, lat}}
+	}
+	_, err = testDb.Seed(context.Background(), coll,
+		bson.M{"_id": "nyc", "location": point(-73.99, 40.73)},
+		bson.M{"_id": "sf", "location": point(-122.42, 37.77)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// $near requires a geospatial index, so this fails without one.
+	filter := bson.M{
+		"location": bson.M{
+			"$near": bson.M{
+				"$geometry":    point(-74.0, 40.7),
+				"$maxDistance": 10000, // meters
+			},
+		},
+	}
+	var docs []bson.M
+	if err := testdb.FindAll(context.Background(), coll, filter, &docs); err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 || docs[0]["_id"] != "nyc" {
+		t.Errorf("got %v, expected only nyc", docs)
+	}
+}
+
+func TestTextIndex(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, err := testDb.CreateRandomCollection([]mongo.IndexModel{testdb.TextIndex("title", "body")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	_, err = testDb.Seed(context.Background(), coll,
+		bson.M{"_id": 1, "title": "Gophers", "body": "All about burrowing rodents"},
+		bson.M{"_id": 2, "title": "Badgers", "body": "Digging for dinner"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// $text requires a text index, so this fails without one.
+	var docs []bson.M
+	if err := testdb.FindAll(context.Background(), coll, bson.M{"$text": bson.M{"$search": "rodents"}}, &docs); err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 || docs[0]["_id"] != int32(1) {
+		t.Errorf("got %v, expected only document 1", docs)
+	}
+}
+
+func TestDropIndexes(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, info, err := testDb.CreateRandomCollectionInfo([]mongo.IndexModel{testdb.TextIndex("body")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+	if len(info.Indexes) != 2 {
+		t.Fatalf("got indexes %v, expected _id_ and a text index", info.Indexes)
+	}
+
+	if err := testDb.DropIndexes(context.Background(), coll); err != nil {
+		t.Fatal(err)
+	}
+
+	specs, err := coll.Indexes().ListSpecifications(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 1 || specs[0].Name != "_id_" {
+		t.Errorf("got %d indexes, expected only _id_", len(specs))
+	}
+}
+
+func TestVerifyIndexes(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	testDb.SetVerifyIndexes(true)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "a", Value: 1}, {Key: "b", Value: -1}},
+			Options: options.Index().SetUnique(true),
+		},
+		testdb.GeoIndex("location"),
+		testdb.TextIndex("title", "body"),
+	}
+	coll, err := testDb.CreateRandomCollection(indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+}
+
+func TestCreateRandomCollectionLike(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	testDb.SetVerifyIndexes(true)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	src, err := testDb.CreateRandomCollection([]mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "iamunique", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		testdb.TextIndex("title"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Drop(context.Background())
+
+	coll, err := testDb.CreateRandomCollectionLike(context.Background(), src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+	if coll.Name() == src.Name() {
+		t.Fatal("expected a new collection, got the source collection")
+	}
+
+	specs, err := coll.Indexes().ListSpecifications(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 3 {
+		t.Errorf("got %d indexes, expected 3 (_id, unique, and text)", len(specs))
+	}
+	testdb.AssertUniqueEnforced(t, coll, bson.M{"iamunique": "a"})
+}
+
+func TestNamedIndex(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	index := testdb.NamedIndex("by_color", bson.D{{Key: "color", Value: 1}})
+	coll, err := testDb.CreateRandomCollection([]mongo.IndexModel{index})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	found, err := testdb.HasIndex(context.Background(), coll, "by_color")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Error("expected an index named by_color, did not find one")
+	}
+}
+
+func TestIndexNames(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, err := testDb.CreateRandomCollection([]mongo.IndexModel{
+		testdb.NamedIndex("b", bson.D{{Key: "b", Value: 1}}),
+		testdb.NamedIndex("a", bson.D{{Key: "a", Value: 1}}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	tests := []struct {
+		includeID bool
+		expect    string
+	}{
+		{false, "[a b]"},
+		{true, "[_id_ a b]"},
+	}
+	for _, tc := range tests {
+		names, err := testdb.IndexNames(context.Background(), coll, tc.includeID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(names); got != tc.expect {
+			t.Errorf("includeID=%t: got %s, expected %s", tc.includeID, got, tc.expect)
+		}
+	}
+}
+
+func TestClusteredIndex(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	opts := options.CreateCollection().SetClusteredIndex(testdb.ClusteredIndex())
+	coll, err := testDb.CreateRandomCollectionWithOptions(opts, testdb.NoIndexes)
+	if err != nil && strings.Contains(err.Error(), "require MongoDB") {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	specs, err := coll.Database().ListCollectionSpecifications(context.Background(), bson.M{"name": coll.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 1 {
+		t.Fatalf("got %d collections named %s, expected 1", len(specs), coll.Name())
+	}
+	if _, err := specs[0].Options.LookupErr("clusteredIndex"); err != nil {
+		t.Errorf("expected the collection to be clustered, got options %s", specs[0].Options)
+	}
+}
+
+func TestClusteredIndexUnreachable(t *testing.T) {
+	testDb := testdb.NewTestDB("mongodb://localhost:1", "test", defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	// Failing to find the server's version isn't the same as it being too old.
+	opts := options.CreateCollection().SetClusteredIndex(testdb.ClusteredIndex())
+	_, err := testDb.CreateRandomCollectionWithOptions(opts, testdb.NoIndexes)
+	if !testdb.IsConnectionError(err) {
+		t.Fatalf("got error %v, expected a connection error", err)
+	}
+	if errors.Is(err, testdb.ErrConnect) {
+		t.Errorf("got error %v, expected ErrConnect only from Connect", err)
+	}
+	if strings.Contains(err.Error(), "require MongoDB") {
+		t.Errorf("got error %q, expected it not to blame the server version", err)
+	}
+}
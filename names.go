@@ -0,0 +1,206 @@
+package testdb
+
+import (
+	crand "crypto/rand"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// SetCryptoRandNames makes the TestDB generate random collection names with
+// crypto/rand instead of math/rand. math/rand is seeded from the clock, so test
+// binaries started at the same instant could in theory generate the same names;
+// crypto/rand rules that out at the cost of being slower.
+//
+// This method must be called before creating any collections to take effect.
+func (t *TestDB) SetCryptoRandNames(enabled bool) {
+	t.cryptoRandNames = enabled
+}
+
+// SetNameFunc makes CreateRandomCollection and friends name collections by
+// calling fn instead of using the default "test_" + 8 random characters. This
+// lets teams follow their own conventions, like including a ticket number or
+// timestamp. fn must return a different name every time; names that aren't
+// legal collection names make collection creation fail.
+//
+// This method must be called before creating any collections to take effect.
+func (t *TestDB) SetNameFunc(fn func() string) {
+	t.nameFunc = fn
+}
+
+// CaseInsensitiveAlphabet can be passed to SetNameAlphabet to generate random
+// names that are unique even when compared case-insensitively.
+var CaseInsensitiveAlphabet = []rune("abcdefghijklmnopqrstuvwxyz0123456789")
+
+// SetNameAlphabet sets the characters that random collection and database
+// names are made of. The default is upper and lower case ASCII letters, so two
+// names can differ only by case, which could collide on case-insensitive
+// filesystems; CaseInsensitiveAlphabet avoids that. An error is returned if the
+// alphabet is empty or contains characters that aren't allowed in names.
+//
+// This method must be called before creating any collections to take effect.
+func (t *TestDB) SetNameAlphabet(runes []rune) error {
+	if len(runes) == 0 {
+		return fmt.Errorf("name alphabet must not be empty")
+	}
+	for _, r := range runes {
+		// These aren't allowed in database names, and '$' and null aren't
+		// allowed in collection names either.
+		if strings.ContainsRune("/\\. \"$*<>:|?\x00", r) {
+			return fmt.Errorf("name alphabet must not contain %q", r)
+		}
+	}
+	t.alphabet = append([]rune(nil), runes...)
+	return nil
+}
+
+// Origins that can be passed to SetNameOrigin.
+const (
+	NameOriginPID      = "pid"
+	NameOriginHostname = "hostname"
+)
+
+// maxOriginLen is the longest the origin part of a collection name can be.
+const maxOriginLen = 32
+
+// SetNameOrigin makes random collection names say where they came from, e.g.
+// "test_ci-worker-3_abcdefgh" instead of "test_abcdefgh", so leftovers from a
+// particular CI worker are easy to attribute and clean up. origin is
+// NameOriginPID for the process ID, NameOriginHostname for the hostname, or ""
+// for neither, which is the default. Hostnames are sanitized to valid name
+// characters and truncated to 32 bytes. It has no effect when SetNameFunc is
+// used. An error is returned if origin is unknown or the hostname can't be
+// looked up.
+//
+// This method must be called before creating any collections to take effect.
+func (t *TestDB) SetNameOrigin(origin string) error {
+	switch origin {
+	case "":
+		t.nameOrigin = ""
+	case NameOriginPID:
+		t.nameOrigin = strconv.Itoa(os.Getpid())
+	case NameOriginHostname:
+		host, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("looking up the hostname: %w", err)
+		}
+		t.nameOrigin = sanitizeName(host, maxOriginLen)
+	default:
+		return fmt.Errorf("unknown name origin %q", origin)
+	}
+	return nil
+}
+
+// maxNamespaceLen is the longest a "<db>.<collection>" namespace can be.
+const maxNamespaceLen = 255
+
+// maxHintLen is the longest the hint part of a collection name can be.
+const maxHintLen = 64
+
+// collectionName returns the name for a new collection in db, including hint
+// if it isn't empty.
+func (t *TestDB) collectionName(db, hint string) (string, error) {
+	if t.nameFunc == nil {
+		name := "test_"
+		if t.nameOrigin != "" {
+			name += t.nameOrigin + "_"
+		}
+		if hint != "" {
+			name += sanitizeName(hint, maxHintLen) + "_"
+		}
+		name += t.randSeq(8)
+		if err := validateCollectionName(db, name); err != nil {
+			return "", err
+		}
+		return name, nil
+	}
+
+	name := t.nameFunc()
+	if err := validateCollectionName(db, name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// validateCollectionName returns an error if name can't be used as the name of
+// a collection in db.
+func validateCollectionName(db, name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("invalid collection name: must not be empty")
+	case strings.ContainsAny(name, "$\x00"):
+		return fmt.Errorf("invalid collection name %q: must not contain '$' or null characters", name)
+	case strings.HasPrefix(name, "system."):
+		return fmt.Errorf("invalid collection name %q: must not start with \"system.\"", name)
+	case len(db)+1+len(name) > maxNamespaceLen:
+		return fmt.Errorf("invalid collection name %q: namespace must be at most %d bytes", name, maxNamespaceLen)
+	}
+	return nil
+}
+
+// sanitizeName replaces every character of s that isn't an ASCII letter, digit,
+// '_', or '-' with '_', so it can be used in database and collection names, and
+// truncates it to at most n bytes.
+func sanitizeName(s string, n int) string {
+	b := []byte(s)
+	for i, c := range b {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '_', c == '-':
+		default:
+			b[i] = '_'
+		}
+	}
+	if len(b) > n {
+		b = b[:n]
+	}
+	return string(b)
+}
+
+var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+
+// randSeqFunc, if it isn't nil, replaces the random part of every generated
+// name. It's nil except in tests, which set it to make names deterministic.
+var randSeqFunc func(alphabet []rune, n int) string
+
+// randSeq returns n random characters from the TestDB's alphabet, using
+// crypto/rand if the TestDB was configured to.
+func (t *TestDB) randSeq(n int) string {
+	alphabet := letters
+	if len(t.alphabet) > 0 {
+		alphabet = t.alphabet
+	}
+	if randSeqFunc != nil {
+		return randSeqFunc(alphabet, n)
+	}
+	if t.cryptoRandNames {
+		return cryptoRandSeq(alphabet, n)
+	}
+	return randSeq(alphabet, n)
+}
+
+func randSeq(alphabet []rune, n int) string {
+	b := make([]rune, n)
+	for i := range b {
+		b[i] = alphabet[rand.Intn(len(alphabet))]
+	}
+	return string(b)
+}
+
+func cryptoRandSeq(alphabet []rune, n int) string {
+	limit := big.NewInt(int64(len(alphabet)))
+	b := make([]rune, n)
+	for i := range b {
+		// crand.Int returns a uniform value in [0, limit), so there's no modulo bias.
+		j, err := crand.Int(crand.Reader, limit)
+		if err != nil {
+			// The system's secure random source is unavailable, which
+			// math/rand is still good enough to work around.
+			return randSeq(alphabet, n)
+		}
+		b[i] = alphabet[j.Int64()]
+	}
+	return string(b)
+}
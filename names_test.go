@@ -0,0 +1,208 @@
+package testdb_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mongo-go/testdb"
+)
+
+func TestSetNameFunc(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+
+	n := 0
+	testDb.SetNameFunc(func() string {
+		n++
+		return fmt.Sprintf("ticket123_%d", n)
+	})
+
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, err := testDb.CreateRandomCollection(testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	if coll.Name() != "ticket123_1" {
+		t.Errorf("got name %q, expected ticket123_1", coll.Name())
+	}
+}
+
+func TestSetNameFuncInvalid(t *testing.T) {
+	for _, name := range []string{"", "bad$name", "system.test", strings.Repeat("a", 300)} {
+		testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+		testDb.SetNameFunc(func() string { return name })
+		if err := testDb.Connect(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := testDb.CreateRandomCollection(testdb.NoIndexes); err == nil {
+			t.Errorf("%q: expected an error, did not get one", name)
+		}
+		testDb.Close()
+	}
+}
+
+func TestSetNameAlphabet(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+
+	for _, alphabet := range [][]rune{nil, []rune("ab$"), []rune("a.b"), []rune("a b")} {
+		if err := testDb.SetNameAlphabet(alphabet); err == nil {
+			t.Errorf("%q: expected an error, did not get one", string(alphabet))
+		}
+	}
+
+	if err := testDb.SetNameAlphabet(testdb.CaseInsensitiveAlphabet); err != nil {
+		t.Fatal(err)
+	}
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, err := testDb.CreateRandomCollection(testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	random := strings.TrimPrefix(coll.Name(), "test_")
+	if strings.Trim(random, string(testdb.CaseInsensitiveAlphabet)) != "" {
+		t.Errorf("got name %q, expected only characters from the alphabet after test_", coll.Name())
+	}
+}
+
+func TestSetCryptoRandNames(t *testing.T) {
+	// Database names are generated without talking to the server.
+	testDb := testdb.NewTestDB("mongodb://localhost:1", "test", defaultTimeout)
+	testDb.SetCryptoRandNames(true)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	letters := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	for _, alphabet := range []string{letters, string(testdb.CaseInsensitiveAlphabet)} {
+		if err := testDb.SetNameAlphabet([]rune(alphabet)); err != nil {
+			t.Fatal(err)
+		}
+		seen := map[string]bool{}
+		for i := 0; i < 100; i++ {
+			db, err := testDb.CreateRandomDatabase()
+			if err != nil {
+				t.Fatal(err)
+			}
+			random := strings.TrimPrefix(db.Name(), "test_")
+			if len(random) != 8 || strings.Trim(random, alphabet) != "" {
+				t.Fatalf("got name %q, expected test_ and then 8 characters from %q", db.Name(), alphabet)
+			}
+			seen[random] = true
+		}
+		if len(seen) < 100 {
+			t.Errorf("got %d distinct names out of 100, expected no repeats", len(seen))
+		}
+	}
+}
+
+func TestSetNameOrigin(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.SetNameOrigin("nope"); err == nil {
+		t.Error("expected an error for an unknown origin, did not get one")
+	}
+	if err := testDb.SetNameOrigin(testdb.NameOriginPID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, err := testDb.CreateRandomCollection(testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	prefix := fmt.Sprintf("test_%d_", os.Getpid())
+	if !strings.HasPrefix(coll.Name(), prefix) || len(coll.Name()) != len(prefix)+8 {
+		t.Errorf("got name %q, expected %s followed by 8 random characters", coll.Name(), prefix)
+	}
+}
+
+func TestCreateRandomCollectionHint(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	tests := []struct {
+		hint   string
+		prefix string
+	}{
+		{"orders", "test_orders_"},
+		{"user.profile $v2", "test_user_profile__v2_"},
+		{strings.Repeat("x", 100), "test_" + strings.Repeat("x", 64) + "_"},
+	}
+	for _, tc := range tests {
+		coll, err := testDb.CreateRandomCollectionHint(tc.hint, testdb.NoIndexes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer coll.Drop(context.Background())
+
+		if !strings.HasPrefix(coll.Name(), tc.prefix) || len(coll.Name()) != len(tc.prefix)+8 {
+			t.Errorf("%q: got name %q, expected %s followed by 8 random characters", tc.hint, coll.Name(), tc.prefix)
+		}
+	}
+}
+
+func TestNamesDeterministic(t *testing.T) {
+	// Each name gets the next letter of the alphabet repeated.
+	i := 0
+	testdb.SetRandSeq(t, func(alphabet []rune, n int) string {
+		s := strings.Repeat(string(alphabet[i%len(alphabet)]), n)
+		i++
+		return s
+	})
+
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.SetNameAlphabet(testdb.CaseInsensitiveAlphabet); err != nil {
+		t.Fatal(err)
+	}
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	expect := []string{"test_aaaaaaaa", "test_orders_bbbbbbbb"}
+	var got []string
+	coll, err := testDb.CreateRandomCollection(testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+	got = append(got, coll.Name())
+
+	coll, err = testDb.CreateRandomCollectionHint("orders", testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+	got = append(got, coll.Name())
+
+	for i := range expect {
+		if got[i] != expect[i] {
+			t.Errorf("got names %v, expected %v", got, expect)
+			break
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package testdb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// FindOne finds a single document in coll matching filter and decodes it into
+// out. If no document matches, it returns false and a nil error, and out is
+// left untouched. Any other error, including one from decoding, is returned
+// with found set to false.
+//
+// opts are passed through to the driver, so they can be used to sort or project
+// the result. If more than one is given they're merged in order, with later
+// options overriding earlier ones.
+func FindOne(ctx context.Context, coll *mongo.Collection, filter, out interface{}, opts ...*options.FindOneOptions) (found bool, err error) {
+	err = coll.FindOne(ctx, filter, opts...).Decode(out)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// FindAll finds all documents in coll matching filter and decodes them into
+// out, which must be a pointer to a slice. opts are passed through to the driver
+// the same way as they are by FindOne.
+func FindAll(ctx context.Context, coll *mongo.Collection, filter, out interface{}, opts ...*options.FindOptions) error {
+	cur, err := coll.Find(ctx, filter, opts...)
+	if err != nil {
+		return err
+	}
+	return cur.All(ctx, out)
+}
+
+// WithReadPreference returns a copy of coll that reads with rp, e.g.
+// readpref.Secondary(), so a single call to FindOne, FindAll, Distinct, or the
+// driver can target secondaries without changing the rest of the test. coll
+// itself keeps its read preference, which defaults to the client's.
+func WithReadPreference(coll *mongo.Collection, rp *readpref.ReadPref) *mongo.Collection {
+	// Clone only fails for invalid options, and a read preference is always
+	// valid.
+	clone, err := coll.Clone(options.Collection().SetReadPreference(rp))
+	if err != nil {
+		return coll
+	}
+	return clone
+}
+
+// Upsert updates the document in coll matching filter, inserting one if none
+// matches, and decodes the resulting document into out. update must be an
+// update document like {"$set": ...}, not a replacement. Errors from the driver
+// are returned as-is.
+func Upsert(ctx context.Context, coll *mongo.Collection, filter, update, out interface{}) error {
+	opts := options.FindOneAndUpdate().
+		SetUpsert(true).
+		SetReturnDocument(options.After)
+	return coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(out)
+}
+
+// Distinct returns the distinct values of field among the documents in coll
+// matching filter, e.g. to assert on the set of values a test produced. A nil
+// filter matches every document. Errors from the driver are returned as-is.
+func Distinct(ctx context.Context, coll *mongo.Collection, field string, filter interface{}) ([]interface{}, error) {
+	if filter == nil {
+		filter = bson.D{}
+	}
+	return coll.Distinct(ctx, field, filter)
+}
+
+// Explain runs the explain command for a find on coll with filter and returns
+// the result, so tests can check how the server runs the query, e.g. that its
+// queryPlanner.winningPlan uses an index (an IXSCAN stage) rather than a
+// collection scan (COLLSCAN). The layout of the result varies between server
+// versions. Errors from the command are returned as-is.
+func Explain(ctx context.Context, coll *mongo.Collection, filter interface{}) (bson.M, error) {
+	if filter == nil {
+		filter = bson.D{}
+	}
+	cmd := bson.D{
+		{Key: "explain", Value: bson.D{
+			{Key: "find", Value: coll.Name()},
+			{Key: "filter", Value: filter},
+		}},
+		{Key: "verbosity", Value: "queryPlanner"},
+	}
+
+	var res bson.M
+	if err := coll.Database().RunCommand(ctx, cmd).Decode(&res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// EstimatedCount returns the number of documents in coll from the collection's
+// metadata, without scanning it, so it stays fast on large seeded datasets
+// where CountDocuments can be slow. The tradeoff is accuracy: it can't take a
+// filter, and after an unclean shutdown or on a sharded cluster with orphaned
+// documents or migrations in progress, it can be off. Errors from the driver
+// are returned as-is.
+func EstimatedCount(ctx context.Context, coll *mongo.Collection) (int64, error) {
+	return coll.EstimatedDocumentCount(ctx)
+}
+
+// Stream finds the documents in coll matching filter and sends them on the
+// returned document channel one at a time as they're read from the cursor, so
+// large result sets can be processed without holding them all in memory. The
+// document channel is closed once every document has been sent or an error
+// has occurred. At most one error is then sent on the error channel, which is
+// closed afterwards, so reading it after the document channel is closed tells
+// whether the stream was complete. If ctx is done first, the cursor is closed
+// and ctx.Err() is sent, rather than whatever error the driver returned
+// because of it. A nil filter matches every document.
+func Stream(ctx context.Context, coll *mongo.Collection, filter interface{}) (<-chan bson.M, <-chan error) {
+	if filter == nil {
+		filter = bson.D{}
+	}
+	docs := make(chan bson.M)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(errs)
+		err := stream(ctx, coll, filter, docs)
+		close(docs)
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			errs <- err
+		}
+	}()
+	return docs, errs
+}
+
+// stream implements Stream, sending documents on docs.
+func stream(ctx context.Context, coll *mongo.Collection, filter interface{}, docs chan<- bson.M) error {
+	cur, err := coll.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(context.Background())
+
+	for cur.Next(ctx) {
+		var doc bson.M
+		if err := cur.Decode(&doc); err != nil {
+			return err
+		}
+		select {
+		case docs <- doc:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return cur.Err()
+}
+
+// TailableCursor opens a tailable-await cursor over the documents in coll
+// matching filter, which must be a capped collection, like one created by
+// CreateRandomCappedCollection. Unlike a normal cursor, it stays open after
+// the last document, and Next blocks until more are inserted or ctx is done,
+// which is how oplog-like tailing works. A nil filter matches every document.
+// The caller must close the cursor.
+func TailableCursor(ctx context.Context, coll *mongo.Collection, filter interface{}) (*mongo.Cursor, error) {
+	if filter == nil {
+		filter = bson.D{}
+	}
+	opts := options.Find().SetCursorType(options.TailableAwait)
+	return coll.Find(ctx, filter, opts)
+}
+
+// Dump returns every document in coll, sorted by _id so the result is the same
+// from run to run. It's meant for golden tests that compare a collection's
+// final state against a snapshot.
+func Dump(ctx context.Context, coll *mongo.Collection) ([]bson.M, error) {
+	var docs []bson.M
+	if err := FindAll(ctx, coll, bson.D{}, &docs, dumpOptions()); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// DumpJSON is like Dump, but returns the documents as canonical extended JSON,
+// one document per line, so the output can be compared byte for byte against
+// a golden file. Field order is preserved as stored. The output can be loaded
+// back into a collection with SeedNDJSON.
+func DumpJSON(ctx context.Context, coll *mongo.Collection) ([]byte, error) {
+	var docs []bson.Raw
+	if err := FindAll(ctx, coll, bson.D{}, &docs, dumpOptions()); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	for _, doc := range docs {
+		b, err := bson.MarshalExtJSON(doc, true, false)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// dumpOptions sorts by _id, which is unique, so the order is deterministic.
+func dumpOptions() *options.FindOptions {
+	return options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+}
+
+// CollectionsEqual returns true if a and b hold the same documents, in any
+// order, e.g. to check that a migration copied a collection correctly.
+// Documents are compared as BSON with their fields sorted, so two documents
+// with the same fields in a different order are equal, but values must have the
+// same types, e.g. an int32 1 doesn't equal a double 1.
+func CollectionsEqual(ctx context.Context, a, b *mongo.Collection) (bool, error) {
+	return collectionsEqual(ctx, a, b, false)
+}
+
+// CollectionsEqualIgnoringID is like CollectionsEqual, but _id fields are
+// ignored, for copies that were inserted with new _ids.
+func CollectionsEqualIgnoringID(ctx context.Context, a, b *mongo.Collection) (bool, error) {
+	return collectionsEqual(ctx, a, b, true)
+}
+
+func collectionsEqual(ctx context.Context, a, b *mongo.Collection, ignoreID bool) (bool, error) {
+	counts := map[string]int{}
+	add := func(coll *mongo.Collection, delta int) (int, error) {
+		var docs []bson.D
+		if err := FindAll(ctx, coll, bson.D{}, &docs); err != nil {
+			return 0, err
+		}
+		for _, doc := range docs {
+			if ignoreID {
+				doc = withoutID(doc)
+			}
+			b, err := bson.Marshal(canonicalDoc(doc))
+			if err != nil {
+				return 0, err
+			}
+			counts[string(b)] += delta
+		}
+		return len(docs), nil
+	}
+
+	na, err := add(a, 1)
+	if err != nil {
+		return false, err
+	}
+	nb, err := add(b, -1)
+	if err != nil {
+		return false, err
+	}
+	if na != nb {
+		return false, nil
+	}
+	for _, n := range counts {
+		if n != 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// withoutID returns doc without its top-level _id field.
+func withoutID(doc bson.D) bson.D {
+	out := make(bson.D, 0, len(doc))
+	for _, e := range doc {
+		if e.Key != "_id" {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// canonicalDoc returns a copy of doc with the fields of it and every embedded
+// document sorted by name, with embedded maps turned into documents so that
+// they marshal the same way every time. Arrays keep their order.
+func canonicalDoc(doc bson.D) bson.D {
+	out := make(bson.D, len(doc))
+	for i, e := range doc {
+		out[i] = bson.E{Key: e.Key, Value: canonicalValue(e.Value)}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+func canonicalValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case primitive.D:
+		return canonicalDoc(v)
+	case primitive.M:
+		return canonicalMap(v)
+	case map[string]interface{}:
+		return canonicalMap(v)
+	case []interface{}:
+		return canonicalValue(primitive.A(v))
+	case primitive.A:
+		out := make(primitive.A, len(v))
+		for i, e := range v {
+			out[i] = canonicalValue(e)
+		}
+		return out
+	}
+	return v
+}
+
+func canonicalMap(m map[string]interface{}) bson.D {
+	doc := make(bson.D, 0, len(m))
+	for k, v := range m {
+		doc = append(doc, bson.E{Key: k, Value: v})
+	}
+	return canonicalDoc(doc)
+}
@@ -0,0 +1,496 @@
+package testdb_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+
+	"github.com/mongo-go/testdb"
+)
+
+func TestFindOne(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, err := testDb.CreateRandomCollection(testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	if _, err := testDb.Seed(context.Background(), coll, widget{ID: "w1", Color: "red"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var w widget
+	found, err := testdb.FindOne(context.Background(), coll, bson.M{"color": "red"}, &w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatal("expected to find a document, did not")
+	}
+	if w.ID != "w1" {
+		t.Errorf("got id %q, expected w1", w.ID)
+	}
+
+	// No match isn't an error.
+	found, err = testdb.FindOne(context.Background(), coll, bson.M{"color": "purple"}, &w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Error("expected not to find a document, but did")
+	}
+}
+
+func TestFindAll(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, err := testDb.CreateRandomCollection(testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	_, err = testDb.Seed(context.Background(), coll,
+		widget{ID: "w1", Color: "red"},
+		widget{ID: "w2", Color: "blue"},
+		widget{ID: "w3", Color: "red"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var widgets []widget
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}})
+	if err := testdb.FindAll(context.Background(), coll, bson.M{"color": "red"}, &widgets, opts); err != nil {
+		t.Fatal(err)
+	}
+	if len(widgets) != 2 || widgets[0].ID != "w3" || widgets[1].ID != "w1" {
+		t.Errorf("got %+v, expected w3 then w1", widgets)
+	}
+
+	// The limit from the later options is applied on top of the sort.
+	widgets = nil
+	err = testdb.FindAll(context.Background(), coll, bson.M{}, &widgets, opts, options.Find().SetLimit(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(widgets) != 1 || widgets[0].ID != "w3" {
+		t.Errorf("got %+v, expected only w3", widgets)
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, err := testDb.CreateRandomCollection(testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	// The first upsert inserts.
+	var w widget
+	err = testdb.Upsert(context.Background(), coll, bson.M{"_id": "w1"}, bson.M{"$set": bson.M{"color": "red"}}, &w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.ID != "w1" || w.Color != "red" {
+		t.Errorf("got %+v, expected w1 to be red", w)
+	}
+
+	// The second one updates.
+	err = testdb.Upsert(context.Background(), coll, bson.M{"_id": "w1"}, bson.M{"$set": bson.M{"color": "blue"}}, &w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.ID != "w1" || w.Color != "blue" {
+		t.Errorf("got %+v, expected w1 to be blue", w)
+	}
+}
+
+func TestDump(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, err := testDb.CreateRandomCollection(testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	// Inserted out of order to check that the dump is sorted.
+	_, err = testDb.Seed(context.Background(), coll,
+		widget{ID: "w2", Color: "blue"},
+		widget{ID: "w1", Color: "red"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	docs, err := testdb.Dump(context.Background(), coll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 2 || docs[0]["_id"] != "w1" || docs[1]["_id"] != "w2" {
+		t.Errorf("got %v, expected w1 then w2", docs)
+	}
+
+	got, err := testdb.DumpJSON(context.Background(), coll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `{"_id":"w1","color":"red"}` + "\n" + `{"_id":"w2","color":"blue"}` + "\n"
+	if string(got) != expect {
+		t.Errorf("got JSON %q, expected %q", got, expect)
+	}
+}
+
+func TestTailableCursor(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, err := testDb.CreateRandomCappedCollection(4096, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	// A tailable cursor over an empty collection is closed immediately, so
+	// start with one document.
+	if _, err := testDb.Seed(context.Background(), coll, widget{ID: "w1", Color: "red"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cur, err := testdb.TailableCursor(ctx, coll, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cur.Close(context.Background())
+
+	if !cur.Next(ctx) {
+		t.Fatalf("expected the first document, got none (err: %v)", cur.Err())
+	}
+	if _, err := testDb.Seed(context.Background(), coll, widget{ID: "w2", Color: "blue"}); err != nil {
+		t.Fatal(err)
+	}
+	if !cur.Next(ctx) {
+		t.Fatalf("expected the cursor to see the new document, got none (err: %v)", cur.Err())
+	}
+	var w widget
+	if err := cur.Decode(&w); err != nil {
+		t.Fatal(err)
+	}
+	if w.ID != "w2" {
+		t.Errorf("got id %q, expected w2", w.ID)
+	}
+}
+
+func TestCollectionsEqual(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	newColl := func(docs ...interface{}) *mongo.Collection {
+		coll, err := testDb.CreateRandomCollection(testdb.NoIndexes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { coll.Drop(context.Background()) })
+		if _, err := testDb.Seed(context.Background(), coll, docs...); err != nil {
+			t.Fatal(err)
+		}
+		return coll
+	}
+
+	a := newColl(
+		bson.D{{Key: "_id", Value: 1}, {Key: "x", Value: 1}, {Key: "y", Value: bson.D{{Key: "p", Value: 1}, {Key: "q", Value: 2}}}},
+		bson.D{{Key: "_id", Value: 2}, {Key: "x", Value: 2}},
+	)
+	// Same documents, inserted in a different order with fields reordered.
+	sameAsA := newColl(
+		bson.D{{Key: "x", Value: 2}, {Key: "_id", Value: 2}},
+		bson.D{{Key: "y", Value: bson.D{{Key: "q", Value: 2}, {Key: "p", Value: 1}}}, {Key: "x", Value: 1}, {Key: "_id", Value: 1}},
+	)
+	// Same documents with different _ids.
+	newIDs := newColl(
+		bson.D{{Key: "_id", Value: 3}, {Key: "x", Value: 1}, {Key: "y", Value: bson.D{{Key: "p", Value: 1}, {Key: "q", Value: 2}}}},
+		bson.D{{Key: "_id", Value: 4}, {Key: "x", Value: 2}},
+	)
+
+	tests := []struct {
+		name   string
+		equal  func(context.Context, *mongo.Collection, *mongo.Collection) (bool, error)
+		b      *mongo.Collection
+		expect bool
+	}{
+		{"reordered", testdb.CollectionsEqual, sameAsA, true},
+		{"new ids", testdb.CollectionsEqual, newIDs, false},
+		{"new ids ignoring ids", testdb.CollectionsEqualIgnoringID, newIDs, true},
+	}
+	for _, tc := range tests {
+		got, err := tc.equal(context.Background(), a, tc.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.expect {
+			t.Errorf("%s: got equal=%t, expected %t", tc.name, got, tc.expect)
+		}
+	}
+}
+
+func TestDistinct(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, err := testDb.CreateRandomCollection(testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	_, err = testDb.Seed(context.Background(), coll,
+		widget{ID: "w1", Color: "red"},
+		widget{ID: "w2", Color: "blue"},
+		widget{ID: "w3", Color: "red"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	colors, err := testdb.Distinct(context.Background(), coll, "color", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(colors) != 2 {
+		t.Errorf("got colors %v, expected red and blue", colors)
+	}
+
+	colors, err = testdb.Distinct(context.Background(), coll, "color", bson.M{"_id": "w2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(colors) != 1 || colors[0] != "blue" {
+		t.Errorf("got colors %v, expected only blue", colors)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, err := testDb.CreateRandomCollection([]mongo.IndexModel{
+		testdb.NamedIndex("by_color", bson.D{{Key: "color", Value: 1}}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	tests := []struct {
+		filter interface{}
+		stage  string
+	}{
+		{bson.M{"color": "red"}, "IXSCAN"},
+		{bson.M{"shape": "square"}, "COLLSCAN"},
+	}
+	for _, tc := range tests {
+		plan, err := testdb.Explain(context.Background(), coll, tc.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if planner := fmt.Sprint(plan["queryPlanner"]); !strings.Contains(planner, tc.stage) {
+			t.Errorf("%v: expected a %s stage in the plan, got %s", tc.filter, tc.stage, planner)
+		}
+	}
+}
+
+func TestEstimatedCount(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, err := testDb.CreateRandomCollection(testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	if _, err := testDb.Seed(context.Background(), coll, bson.M{"a": 1}, bson.M{"a": 2}, bson.M{"a": 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := testdb.EstimatedCount(context.Background(), coll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("got count %d, expected 3", n)
+	}
+}
+
+func TestWithReadPreference(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, err := testDb.CreateRandomCollection(testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	if _, err := testDb.Seed(context.Background(), coll, widget{ID: "w1", Color: "red"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// primaryPreferred works against every topology, including a standalone.
+	var got []widget
+	err = testdb.FindAll(context.Background(), testdb.WithReadPreference(coll, readpref.PrimaryPreferred()), bson.M{}, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].ID != "w1" {
+		t.Errorf("got %v, expected w1", got)
+	}
+}
+
+func TestStream(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, err := testDb.CreateRandomCollection(testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	if _, err := testDb.Seed(context.Background(), coll, bson.M{"n": 1}, bson.M{"n": 2}, bson.M{"n": 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	docs, errs := testdb.Stream(context.Background(), coll, bson.M{})
+	n := 0
+	for range docs {
+		n++
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("got %d documents, expected 3", n)
+	}
+
+	// Cancelling stops the stream early. Nothing reads the second document,
+	// so the stream can only end by noticing the cancellation.
+	ctx, cancel := context.WithCancel(context.Background())
+	docs, errs = testdb.Stream(ctx, coll, bson.M{})
+	<-docs
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, expected %v", err, context.Canceled)
+	}
+	if _, ok := <-docs; ok {
+		t.Error("expected the document channel to be closed")
+	}
+
+	// A nil filter matches everything.
+	docs, errs = testdb.Stream(context.Background(), coll, nil)
+	n = 0
+	for range docs {
+		n++
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("got %d documents with a nil filter, expected 3", n)
+	}
+}
+
+func TestStreamCanceledInCursor(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, err := testDb.CreateRandomCollection(testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	// The first batch of a find is 101 documents, so the documents after it
+	// need a getMore, which is what's running when ctx is canceled.
+	fixtures := make([]interface{}, 150)
+	for i := range fixtures {
+		fixtures[i] = bson.M{"n": i}
+	}
+	if _, err := testDb.Seed(context.Background(), coll, fixtures...); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	docs, errs := testdb.Stream(ctx, coll, nil)
+	for i := 0; i < 101; i++ {
+		<-docs
+	}
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("got error %v, expected exactly %v", err, context.Canceled)
+	}
+
+	// The same goes for a ctx that's done before the find even starts.
+	docs, errs = testdb.Stream(ctx, coll, nil)
+	for range docs {
+	}
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("got error %v, expected exactly %v", err, context.Canceled)
+	}
+}
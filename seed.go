@@ -0,0 +1,362 @@
+package testdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// Seed inserts docs into coll and returns how many were inserted. The docs can
+// be anything the driver can marshal, like structs, maps, or bson.D, so tests
+// don't have to build an []interface{} themselves. Seeding zero docs is a
+// no-op.
+//
+// Documents are inserted in order, and inserting stops at the first one that
+// fails, so on error inserted says how many made it in, which is also the
+// index of the document that failed.
+//
+// Seed is bounded only by ctx; it doesn't apply the TestDB's timeout or any
+// other deadline of its own. Large fixtures may need a ctx with a longer
+// deadline than usual, and if ctx expires before the insert finishes, the
+// returned error says so explicitly.
+func (t *TestDB) Seed(ctx context.Context, coll *mongo.Collection, docs ...interface{}) (inserted int, err error) {
+	return t.SeedWithOptions(ctx, coll, nil, docs...)
+}
+
+// defaultSeedBatchSize is how many documents the seeding helpers insert at a
+// time unless SeedOptions.BatchSize says otherwise.
+const defaultSeedBatchSize = 1000
+
+// SeedOptions change how the seeding helpers insert documents. The zero value
+// inserts documents the same way a plain InsertMany would, in batches of 1000.
+type SeedOptions struct {
+	// BypassDocumentValidation inserts documents even if they don't satisfy
+	// the collection's validator. It's useful for staging deliberately bad
+	// data, e.g. to test repair logic.
+	BypassDocumentValidation bool
+
+	// BatchSize is the most documents inserted by a single InsertMany.
+	// Splitting large fixtures into batches keeps each insert under the
+	// server's limits on message size and batch size. Zero means 1000.
+	BatchSize int
+
+	// WriteConcern is the write concern of the inserts, e.g.
+	// writeconcern.Majority() to be sure seeded data is replicated before a
+	// test reads it from a secondary. Nil means coll's write concern.
+	WriteConcern *writeconcern.WriteConcern
+}
+
+// SeedWithOptions is like Seed, but inserts docs according to opts, which may
+// be nil.
+//
+// Documents are inserted in batches, in order. If a batch fails, the error
+// says which documents were in it, and inserted counts the documents in the
+// batches before it plus those in the failed batch before the one that failed.
+func (t *TestDB) SeedWithOptions(ctx context.Context, coll *mongo.Collection, opts *SeedOptions, docs ...interface{}) (inserted int, err error) {
+	if len(docs) == 0 {
+		return 0, nil
+	}
+	if opts == nil {
+		opts = &SeedOptions{}
+	}
+
+	coll, insertOpts, batchSize, err := seedSetup(coll, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	for start := 0; start < len(docs); start += batchSize {
+		end := start + batchSize
+		if end > len(docs) {
+			end = len(docs)
+		}
+
+		if _, err := coll.InsertMany(ctx, docs[start:end], insertOpts); err != nil {
+			what := fmt.Sprintf("documents %d-%d of %d", start, end-1, len(docs))
+			return inserted + insertedBefore(err), seedError(ctx, coll, what, err)
+		}
+		inserted += end - start
+	}
+	return inserted, nil
+}
+
+// seedSetup returns the collection, insert options, and batch size to seed coll
+// with according to opts, which mustn't be nil.
+func seedSetup(coll *mongo.Collection, opts *SeedOptions) (*mongo.Collection, *options.InsertManyOptions, int, error) {
+	insertOpts := options.InsertMany()
+	if opts.BypassDocumentValidation {
+		insertOpts.SetBypassDocumentValidation(true)
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultSeedBatchSize
+	}
+	if opts.WriteConcern != nil {
+		var err error
+		coll, err = coll.Clone(options.Collection().SetWriteConcern(opts.WriteConcern))
+		if err != nil {
+			return nil, nil, 0, err
+		}
+	}
+	return coll, insertOpts, batchSize, nil
+}
+
+// insertedBefore returns how many documents an ordered insert that failed with
+// err inserted before stopping. Any error that doesn't say which document
+// failed is assumed to have inserted nothing.
+func insertedBefore(err error) int {
+	i, _ := firstFailed(err)
+	return i
+}
+
+// firstFailed returns the index of the document that made an ordered insert
+// fail with err, if err says. The server only reports which documents failed,
+// and an ordered insert stops at the first failure, so that's the lowest
+// index reported.
+func firstFailed(err error) (int, bool) {
+	var bwe mongo.BulkWriteException
+	if !errors.As(err, &bwe) || len(bwe.WriteErrors) == 0 {
+		return 0, false
+	}
+	first := bwe.WriteErrors[0].Index
+	for _, we := range bwe.WriteErrors[1:] {
+		if we.Index < first {
+			first = we.Index
+		}
+	}
+	return first, true
+}
+
+// SeedTx seeds every collection in fixtures with its documents in a single
+// transaction, so either all of the fixtures are inserted or, if any insert
+// fails, none are. Collections are seeded in no particular order. Before
+// MongoDB 4.4, collections can't be created in a transaction, so they must
+// already exist.
+//
+// Transactions need a replica set or sharded cluster. On a standalone server,
+// the fixtures are inserted one collection at a time without a transaction,
+// so a failure can leave some of them inserted. transactional says whether a
+// transaction was used, so callers that depend on the all-or-nothing behavior
+// can check for it.
+func (t *TestDB) SeedTx(ctx context.Context, fixtures map[*mongo.Collection][]interface{}) (transactional bool, err error) {
+	topology, err := t.Topology(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	seedAll := func(ctx context.Context) error {
+		for coll, docs := range fixtures {
+			if _, err := t.SeedWithOptions(ctx, coll, nil, docs...); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if topology == TopologyStandalone {
+		return false, seedAll(ctx)
+	}
+
+	sess, err := t.StartSession()
+	if err != nil {
+		return false, err
+	}
+	defer sess.EndSession(context.Background())
+
+	_, err = sess.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, seedAll(sc)
+	})
+	return true, err
+}
+
+// WaitForMajority blocks until the writes made so far on coll's client are
+// majority-committed, or until ctx is done, so that assertions after seeding a
+// replica set can't race ahead of replication, e.g. when reading from a
+// secondary. It does this with a write to coll that changes nothing but uses
+// the majority write concern. On a standalone server there's nothing to wait
+// for, so it returns nil straight away.
+func (t *TestDB) WaitForMajority(ctx context.Context, coll *mongo.Collection) error {
+	topology, err := t.Topology(ctx)
+	if err != nil {
+		return err
+	}
+	if topology == TopologyStandalone {
+		return nil
+	}
+
+	majority, err := coll.Clone(options.Collection().SetWriteConcern(writeconcern.Majority()))
+	if err != nil {
+		return err
+	}
+	// No document has a MinKey _id, so this never matches anything.
+	filter := bson.M{"_id": primitive.MinKey{}}
+	_, err = majority.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"_testdb": true}})
+	return err
+}
+
+// Snapshot captures every document in coll and returns a function that
+// restores coll to them, so a test can mutate shared reference data and put it
+// back afterwards:
+//
+//	restore, err := testDb.Snapshot(ctx, coll)
+//	...
+//	defer restore()
+//
+// Restoring deletes every document in coll and reinserts the captured ones,
+// bypassing document validation, bounded by the TestDB's timeout. Only
+// documents are restored; indexes and collection options changed after the
+// snapshot stay changed. The snapshot is held in memory, so it's meant for
+// small to medium collections.
+func (t *TestDB) Snapshot(ctx context.Context, coll *mongo.Collection) (func() error, error) {
+	var docs []bson.Raw
+	if err := FindAll(ctx, coll, bson.D{}, &docs); err != nil {
+		return nil, err
+	}
+	saved := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		saved[i] = doc
+	}
+
+	restore := func() error {
+		ctx, cancel := t.Context()
+		defer cancel()
+
+		if _, err := coll.DeleteMany(ctx, bson.D{}); err != nil {
+			return fmt.Errorf("restoring snapshot of %s: %w", coll.Name(), err)
+		}
+		_, err := t.SeedWithOptions(ctx, coll, &SeedOptions{BypassDocumentValidation: true}, saved...)
+		return err
+	}
+	return restore, nil
+}
+
+// InsertOne inserts doc into coll and returns its _id. If doc has an _id, that's
+// what's returned, as whatever type it was unmarshaled as; otherwise, the
+// driver generates a primitive.ObjectID for it. Errors from the driver are
+// returned as-is.
+func InsertOne(ctx context.Context, coll *mongo.Collection, doc interface{}) (interface{}, error) {
+	res, err := coll.InsertOne(ctx, doc)
+	if err != nil {
+		return nil, err
+	}
+	return res.InsertedID, nil
+}
+
+// InsertOneObjectID is like InsertOne, but returns the _id as an ObjectID for
+// the common case where it is one. If doc is inserted with an _id of another
+// type, the _id is returned as an error, and doc stays inserted.
+func InsertOneObjectID(ctx context.Context, coll *mongo.Collection, doc interface{}) (primitive.ObjectID, error) {
+	id, err := InsertOne(ctx, coll, doc)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	oid, ok := id.(primitive.ObjectID)
+	if !ok {
+		return primitive.NilObjectID, fmt.Errorf("inserted document has _id %v of type %T, not an ObjectID", id, id)
+	}
+	return oid, nil
+}
+
+// maxNDJSONLine is the longest line SeedNDJSON can read, which is a little
+// more than the server's 16MB document size limit to allow for extended JSON
+// being more verbose than BSON.
+const maxNDJSONLine = 32 << 20
+
+// SeedNDJSON inserts the newline-delimited extended JSON documents read from r
+// into coll and returns how many were inserted. Each non-blank line must hold
+// one document, in canonical or relaxed extended JSON. Documents are read and
+// inserted in batches as r is read, so large fixtures don't have to fit in
+// memory at once.
+//
+// If a line can't be parsed, or its document can't be inserted, the error says
+// which line it was, and the documents before it have already been inserted.
+// Like Seed, it's bounded only by ctx.
+func (t *TestDB) SeedNDJSON(ctx context.Context, coll *mongo.Collection, r io.Reader) (inserted int, err error) {
+	return t.SeedNDJSONWithOptions(ctx, coll, nil, r)
+}
+
+// SeedNDJSONWithOptions is like SeedNDJSON, but inserts the documents according
+// to opts, which may be nil, the same way SeedWithOptions does.
+func (t *TestDB) SeedNDJSONWithOptions(ctx context.Context, coll *mongo.Collection, opts *SeedOptions, r io.Reader) (inserted int, err error) {
+	if opts == nil {
+		opts = &SeedOptions{}
+	}
+	coll, insertOpts, batchSize, err := seedSetup(coll, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxNDJSONLine)
+
+	// lines holds the line number of each document in batch, since blank
+	// lines mean they aren't the same as the documents' indexes.
+	batch := make([]interface{}, 0, batchSize)
+	lines := make([]int, 0, batchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		_, err := coll.InsertMany(ctx, batch, insertOpts)
+		if err != nil {
+			i, ok := firstFailed(err)
+			inserted += i
+			what := fmt.Sprintf("the documents on lines %d-%d", lines[0], lines[len(lines)-1])
+			if ok {
+				what = fmt.Sprintf("the document on line %d", lines[i])
+			}
+			return seedError(ctx, coll, what, err)
+		}
+		inserted += len(batch)
+		batch, lines = batch[:0], lines[:0]
+		return nil
+	}
+
+	for line := 1; scanner.Scan(); line++ {
+		b := bytes.TrimSpace(scanner.Bytes())
+		if len(b) == 0 {
+			continue
+		}
+		var doc bson.D
+		if err := bson.UnmarshalExtJSON(b, false, &doc); err != nil {
+			// Insert the documents read before the bad line, as documented.
+			if err := flush(); err != nil {
+				return inserted, err
+			}
+			return inserted, fmt.Errorf("parsing line %d: %w", line, err)
+		}
+		batch = append(batch, doc)
+		lines = append(lines, line)
+		if len(batch) == batchSize {
+			if err := flush(); err != nil {
+				return inserted, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return inserted, fmt.Errorf("reading documents: %w", err)
+	}
+	if err := flush(); err != nil {
+		return inserted, err
+	}
+	return inserted, nil
+}
+
+// seedError adds context to an error from seeding what, e.g. "documents 0-9 of
+// 20", into coll, calling out when it's because ctx expired.
+func seedError(ctx context.Context, coll *mongo.Collection, what string, err error) error {
+	ns := coll.Database().Name() + "." + coll.Name()
+	if ctx.Err() != nil || mongo.IsTimeout(err) {
+		return fmt.Errorf("seeding %s into %s timed out; use a context with a longer deadline for large fixtures: %w", what, ns, err)
+	}
+	return fmt.Errorf("seeding %s into %s: %w", what, ns, err)
+}
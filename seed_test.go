@@ -0,0 +1,477 @@
+package testdb_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+
+	"github.com/mongo-go/testdb"
+)
+
+type widget struct {
+	ID    string `bson:"_id"`
+	Color string `bson:"color"`
+}
+
+func TestSeed(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, err := testDb.CreateRandomCollection(testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	inserted, err := testDb.Seed(context.Background(), coll,
+		widget{ID: "w1", Color: "red"},
+		widget{ID: "w2", Color: "blue"},
+		bson.M{"color": "green"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inserted != 3 {
+		t.Fatalf("inserted %d documents, expected 3", inserted)
+	}
+
+	n, err := coll.CountDocuments(context.Background(), bson.M{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("got %d documents, expected 3", n)
+	}
+}
+
+func TestSeedTimeout(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, err := testDb.CreateRandomCollection(testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+
+	_, err = testDb.Seed(ctx, coll, bson.M{"a": 1})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, expected it to wrap %v", err, context.DeadlineExceeded)
+	}
+	if err != nil && !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected the error to say seeding timed out, got %q", err)
+	}
+}
+
+func TestSeedBypassDocumentValidation(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	validator := bson.M{
+		"$jsonSchema": bson.M{
+			"bsonType": "object",
+			"required": []string{"color"},
+		},
+	}
+	coll, err := testDb.CreateRandomCollectionWithValidator(validator, testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	invalid := bson.M{"shape": "square"}
+
+	_, err = testDb.Seed(context.Background(), coll, invalid)
+	if !testdb.IsValidationError(err) {
+		t.Errorf("expected a validation error, did not get one (err: %v)", err)
+	}
+
+	opts := &testdb.SeedOptions{BypassDocumentValidation: true}
+	if _, err := testDb.SeedWithOptions(context.Background(), coll, opts, invalid); err != nil {
+		t.Errorf("expected validation to be bypassed (err: %s)", err)
+	}
+}
+
+func TestSeedBatches(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, err := testDb.CreateRandomCollection(testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	// The fourth document is a duplicate, so the second batch fails.
+	docs := []interface{}{
+		bson.M{"_id": 1}, bson.M{"_id": 2}, bson.M{"_id": 3},
+		bson.M{"_id": 1}, bson.M{"_id": 5},
+	}
+	opts := &testdb.SeedOptions{BatchSize: 3}
+	inserted, err := testDb.SeedWithOptions(context.Background(), coll, opts, docs...)
+	if !testdb.IsDupeKeyError(err) {
+		t.Fatalf("expected a duplicate key error, did not get one (err: %v)", err)
+	}
+	if !strings.Contains(err.Error(), "documents 3-4 of 5") {
+		t.Errorf("expected the error to say which batch failed, got %q", err)
+	}
+	if inserted != 3 {
+		t.Errorf("inserted %d documents, expected the 3 from the first batch", inserted)
+	}
+
+	// Within a batch, the documents before the failed one still count.
+	more := []interface{}{bson.M{"_id": 6}, bson.M{"_id": 7}, bson.M{"_id": 2}, bson.M{"_id": 8}}
+	inserted, err = testDb.Seed(context.Background(), coll, more...)
+	if !testdb.IsDupeKeyError(err) {
+		t.Fatalf("expected a duplicate key error, did not get one (err: %v)", err)
+	}
+	if inserted != 2 {
+		t.Errorf("inserted %d documents, expected 2", inserted)
+	}
+}
+
+func TestSeedNDJSON(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, err := testDb.CreateRandomCollection(testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	fixture := `{"_id": "a", "color": "red"}
+
+{"_id": "b", "color": "blue", "n": {"$numberLong": "7"}}
+`
+	n, err := testDb.SeedNDJSON(context.Background(), coll, strings.NewReader(fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("inserted %d documents, expected 2", n)
+	}
+
+	var got widget
+	if err := coll.FindOne(context.Background(), bson.M{"_id": "b"}).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Color != "blue" {
+		t.Errorf("got color %q, expected blue", got.Color)
+	}
+
+	_, err = testDb.SeedNDJSON(context.Background(), coll, strings.NewReader("{\"_id\": \"c\"}\n{oops\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expected an error about line 2, got %v", err)
+	}
+}
+
+func TestSeedNDJSONWithOptions(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, err := testDb.CreateRandomCollection(testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	// With batches of 2, the duplicate _id on line 5 is in the second batch,
+	// and the blank line means documents and lines are numbered differently.
+	fixture := `{"_id": "a"}
+{"_id": "b"}
+
+{"_id": "c"}
+{"_id": "a"}
+{"_id": "d"}
+`
+	opts := &testdb.SeedOptions{BatchSize: 2}
+	n, err := testDb.SeedNDJSONWithOptions(context.Background(), coll, opts, strings.NewReader(fixture))
+	if !testdb.IsDupeKeyError(err) {
+		t.Fatalf("got error %v, expected a duplicate key error", err)
+	}
+	if !strings.Contains(err.Error(), "line 5") {
+		t.Errorf("got error %q, expected it to name line 5", err)
+	}
+	if n != 3 {
+		t.Errorf("inserted %d documents, expected 3", n)
+	}
+}
+
+func TestSeedNDJSONParseErrorMidBatch(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, err := testDb.CreateRandomCollection(testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	// The bad line comes before the first batch of 10 is full.
+	fixture := "{\"_id\": \"a\"}\n{\"_id\": \"b\"}\n{oops\n{\"_id\": \"c\"}\n"
+	opts := &testdb.SeedOptions{BatchSize: 10}
+	n, err := testDb.SeedNDJSONWithOptions(context.Background(), coll, opts, strings.NewReader(fixture))
+	if err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("expected an error about line 3, got %v", err)
+	}
+	if n != 2 {
+		t.Errorf("inserted %d documents, expected the 2 before the bad line", n)
+	}
+	if count, err := coll.CountDocuments(context.Background(), bson.M{}); err != nil || count != 2 {
+		t.Errorf("found %d documents, expected 2 (err: %v)", count, err)
+	}
+}
+
+func TestSeedWriteConcern(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, err := testDb.CreateRandomCollection(testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	opts := &testdb.SeedOptions{WriteConcern: writeconcern.Majority()}
+	inserted, err := testDb.SeedWithOptions(context.Background(), coll, opts, bson.M{"a": 1}, bson.M{"a": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inserted != 2 {
+		t.Errorf("inserted %d documents, expected 2", inserted)
+	}
+
+	// No deployment here has 50 members to acknowledge a write, so the write
+	// concern can only be satisfied if it's ignored.
+	opts = &testdb.SeedOptions{WriteConcern: &writeconcern.WriteConcern{W: 50}}
+	_, err = testDb.SeedWithOptions(context.Background(), coll, opts, bson.M{"a": 3})
+	if !isWriteConcernError(err) {
+		t.Errorf("got error %v, expected a write concern error", err)
+	}
+}
+
+// isWriteConcernError returns true if err says a write concern couldn't be
+// satisfied. Replica sets report that as a write concern error, with code 100
+// (UnsatisfiableWriteConcern); standalone servers reject w > 1 outright with
+// code 2 (BadValue).
+func isWriteConcernError(err error) bool {
+	var bwe mongo.BulkWriteException
+	if errors.As(err, &bwe) && bwe.WriteConcernError != nil {
+		return true
+	}
+	var se mongo.ServerError
+	return errors.As(err, &se) && (se.HasErrorCode(100) || se.HasErrorCode(2))
+}
+
+func TestInsertOne(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, err := testDb.CreateRandomCollection(testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	// A client-provided _id is returned as-is.
+	id, err := testdb.InsertOne(context.Background(), coll, widget{ID: "w1", Color: "red"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "w1" {
+		t.Errorf("got id %v, expected w1", id)
+	}
+	if _, err := testdb.InsertOneObjectID(context.Background(), coll, bson.M{"_id": 7}); err == nil {
+		t.Error("expected an error for a non-ObjectID _id, did not get one")
+	}
+
+	// Otherwise, a new ObjectID is returned.
+	oid, err := testdb.InsertOneObjectID(context.Background(), coll, bson.M{"color": "blue"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oid.IsZero() {
+		t.Fatal("got a zero ObjectID")
+	}
+	var w widget
+	if err := coll.FindOne(context.Background(), bson.M{"_id": oid}).Decode(&w); err != nil {
+		t.Fatal(err)
+	}
+	if w.Color != "blue" {
+		t.Errorf("got color %q, expected blue", w.Color)
+	}
+}
+
+func TestSeedTx(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	testDb.SetExplicitCreate(true)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	topology, err := testDb.Topology(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := testDb.CreateRandomCollection(testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Drop(context.Background())
+	b, err := testDb.CreateRandomCollection(testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Drop(context.Background())
+
+	transactional, err := testDb.SeedTx(context.Background(), map[*mongo.Collection][]interface{}{
+		a: {bson.M{"_id": 1}, bson.M{"_id": 2}},
+		b: {bson.M{"_id": 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := topology != testdb.TopologyStandalone; transactional != want {
+		t.Errorf("got transactional=%t on a %s deployment, expected %t", transactional, topology, want)
+	}
+	for _, coll := range []*mongo.Collection{a, b} {
+		if n, err := coll.CountDocuments(context.Background(), bson.M{}); err != nil || n == 0 {
+			t.Errorf("expected %s to be seeded, found %d documents (err: %v)", coll.Name(), n, err)
+		}
+	}
+	if topology == testdb.TopologyStandalone {
+		t.Skip("rolling back needs a transaction, which needs a replica set")
+	}
+
+	// A duplicate in b rolls back the insert into a.
+	_, err = testDb.SeedTx(context.Background(), map[*mongo.Collection][]interface{}{
+		a: {bson.M{"_id": 3}},
+		b: {bson.M{"_id": 1}},
+	})
+	if !testdb.IsDupeKeyError(err) {
+		t.Fatalf("expected a duplicate key error, did not get one (err: %v)", err)
+	}
+	if n, err := a.CountDocuments(context.Background(), bson.M{"_id": 3}); err != nil || n != 0 {
+		t.Errorf("expected the insert into %s to be rolled back, found %d documents (err: %v)", a.Name(), n, err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, err := testDb.CreateRandomCollection(testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	_, err = testDb.Seed(context.Background(), coll,
+		widget{ID: "w1", Color: "red"},
+		widget{ID: "w2", Color: "blue"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restore, err := testDb.Snapshot(context.Background(), coll)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := coll.UpdateOne(context.Background(), bson.M{"_id": "w1"}, bson.M{"$set": bson.M{"color": "green"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := coll.DeleteOne(context.Background(), bson.M{"_id": "w2"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := coll.InsertOne(context.Background(), widget{ID: "w3", Color: "pink"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []widget
+	if err := testdb.FindAll(context.Background(), coll, bson.M{}, &got, options.Find().SetSort(bson.M{"_id": 1})); err != nil {
+		t.Fatal(err)
+	}
+	expect := []widget{{ID: "w1", Color: "red"}, {ID: "w2", Color: "blue"}}
+	if len(got) != len(expect) || got[0] != expect[0] || got[1] != expect[1] {
+		t.Errorf("got %v after restoring, expected %v", got, expect)
+	}
+}
+
+func TestWaitForMajority(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, err := testDb.CreateRandomCollection(testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	if _, err := testDb.Seed(context.Background(), coll, bson.M{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := testDb.WaitForMajority(context.Background(), coll); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := coll.CountDocuments(context.Background(), bson.M{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("got %d documents, expected the no-op write not to add any", n)
+	}
+}
@@ -4,13 +4,22 @@ package testdb
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
 )
 
 const (
@@ -25,6 +34,10 @@ const (
 	ENV_VAR_TEST_MONGO_DB = "TEST_MONGO_DB"
 )
 
+// errNotConnected is returned by methods that need a connection when Connect
+// hasn't been called yet.
+var errNotConnected = errors.New("must call Connect first")
+
 // NoIndexes can be passed to CreateRandomCollection to create a collection
 // without indexes.
 var NoIndexes []mongo.IndexModel
@@ -33,11 +46,50 @@ func init() { rand.Seed(time.Now().UnixNano()) }
 
 // A TestDB represents a MongoDB database used for running tests against.
 type TestDB struct {
-	url     string
-	db      string
-	timeout time.Duration
+	url         string
+	db          string
+	timeout     time.Duration
+	logger      *options.LoggerOptions
+	registry    *bsoncodec.Registry
+	maxPoolSize uint64
+	compressors []string
+	heartbeat   time.Duration
+	readConcern *readconcern.ReadConcern
+	direct      bool
+	opTimeout   time.Duration
+	ignoreEnv   bool
+	autoEncrypt *options.AutoEncryptionOptions
+	retryWrites *bool
+	retryReads  *bool
+	serverAPI   *options.ServerAPIOptions
+	poolMonitor *event.PoolMonitor
+	recordPool  bool
+
+	indexBuildMaxTime time.Duration
+	cryptoRandNames   bool
+	nameFunc          func() string
+	alphabet          []rune
+	nameOrigin        string
+	minServerVersion  string
+	explicitCreate    bool
+	dropRetries       int
+	verifyIndexes     bool
 	// --
-	client *mongo.Client
+	client      *mongo.Client
+	appliedOpts *options.ClientOptions
+
+	mu          sync.Mutex // guards db, collections, databases, the counts, and lastSetup
+	collections map[string]map[string]struct{}
+	databases   map[string]struct{}
+	created     int
+	dropped     int
+	lastSetup   time.Duration
+
+	// The driver sends pool events synchronously from whatever goroutine is
+	// checking out a connection, including ones that may hold mu, so they're
+	// guarded separately.
+	poolMu     sync.Mutex
+	poolEvents []event.PoolEvent
 }
 
 // NewTestDB creates a new TestDB with the provided url, database name, and
@@ -48,18 +100,38 @@ func NewTestDB(url, db string, timeout time.Duration) *TestDB {
 		url:     url,
 		db:      db,
 		timeout: timeout,
+
+		indexBuildMaxTime: defaultIndexBuildMaxTime,
+		dropRetries:       defaultDropRetries,
 	}
 }
 
+// ValidateURI returns an error if uri isn't a valid MongoDB connection string,
+// using the same parsing as Connect but without connecting. It's useful for
+// checking a url from an environment variable before trying to use it.
+func ValidateURI(uri string) error {
+	if err := options.Client().ApplyURI(uri).Validate(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidURI, err)
+	}
+	return nil
+}
+
+// Context returns a context that times out after the TestDB's timeout, for
+// passing to the TestDB's helpers or to the driver. As with
+// context.WithTimeout, the caller must call the returned cancel function.
+func (t *TestDB) Context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), t.timeout)
+}
+
 // OverrideWithEnvVars overrides the url and database in a TestDB if certain
 // environment variables are set. This makes it easy for multiple people to
 // run tests that require a MongoDB instance even if they have it running at
 // different urls or if they want to use different databases.
 //
 // This method will only do anything if Connect hasn't already been called on
-// the TestDB.
+// the TestDB, and SetIgnoreEnvVars hasn't been used to turn it off.
 func (t *TestDB) OverrideWithEnvVars() {
-	if t.client != nil {
+	if t.client != nil || t.ignoreEnv {
 		return
 	}
 
@@ -67,35 +139,234 @@ func (t *TestDB) OverrideWithEnvVars() {
 		t.url = urlOverride
 	}
 	if dbOverride := os.Getenv(ENV_VAR_TEST_MONGO_DB); dbOverride != "" {
-		t.db = dbOverride
+		t.UseDatabase(dbOverride)
 	}
 }
 
-// Connect initializes a connection to the TestDB. It will return an error if
-// it cannot connect to MongoDB.
-func (t *TestDB) Connect() error {
-	// SetServerSelectionTimeout is different and more important than SetConnectTimeout.
-	// Internally, the mongo driver is polling and updating the topology,
-	// i.e. the list of replicas/nodes in the cluster. SetServerSelectionTimeout
-	// applies to selecting a node from the topology, which should be nearly
-	// instantaneous when the cluster is ok _and_ when it's down. When a node
-	// is down, it's reflected in the topology, so there's no need to wait for
-	// another server because we only use one server: the master replica.
-	// The 500ms below is really how long the driver will wait for the master
-	// replica to come back online.
-	//
-	// SetConnectTimeout is what is seems: timeout when a connection is actually
-	// made. This guards against slows networks, or the case when the mongo driver
-	// thinks the master is online but really it's not.
-	opts := options.Client().
-		ApplyURI(t.url).
-		SetConnectTimeout(t.timeout).
-		SetServerSelectionTimeout(time.Duration(500 * time.Millisecond))
+// SetIgnoreEnvVars makes OverrideWithEnvVars, including the call made by Setup,
+// a no-op, so the environment can't redirect the TestDB to another url or
+// database. Tests that must target a specific deployment, e.g. to check
+// behavior against a deliberately wrong url, can use it to be sure they do.
+func (t *TestDB) SetIgnoreEnvVars(enabled bool) {
+	t.ignoreEnv = enabled
+}
 
-	client, err := mongo.NewClient(opts)
-	if err != nil {
+// EnableDriverLogging makes the driver write its command, connection, topology,
+// and server selection logs to w. It's meant for debugging a single misbehaving
+// test, so logging is off by default.
+//
+// This method must be called before Connect to take effect.
+func (t *TestDB) EnableDriverLogging(w io.Writer) {
+	t.logger = options.Logger().
+		SetSink(&writerSink{w: w}).
+		SetComponentLevel(options.LogComponentAll, options.LogLevelDebug)
+}
+
+// SetBSONRegistry makes the TestDB's client use r to marshal and unmarshal
+// BSON. This lets tests exercise custom type codecs end to end against a real
+// server. By default the driver's default registry is used.
+//
+// This method must be called before Connect to take effect.
+func (t *TestDB) SetBSONRegistry(r *bsoncodec.Registry) {
+	t.registry = r
+}
+
+// SetMaxPoolSize sets the maximum number of connections the TestDB's client
+// keeps open to each server. Benchmarks and load tests may want more than the
+// driver's default of 100. Zero means the driver's default.
+//
+// This method must be called before Connect to take effect.
+func (t *TestDB) SetMaxPoolSize(n uint64) {
+	t.maxPoolSize = n
+}
+
+// SetCompressors sets the wire protocol compressors the TestDB's client offers
+// the server, in order of preference. The driver supports "snappy", "zlib", and
+// "zstd", and an error is returned for anything else. By default, traffic isn't
+// compressed.
+//
+// This method must be called before Connect to take effect.
+func (t *TestDB) SetCompressors(list []string) error {
+	for _, c := range list {
+		switch c {
+		case "snappy", "zlib", "zstd":
+		default:
+			return fmt.Errorf("unsupported compressor %q", c)
+		}
+	}
+	t.compressors = list
+	return nil
+}
+
+// SetHeartbeatInterval sets how often the TestDB's client checks on each server
+// to notice topology changes, like a primary stepping down. Failover tests may
+// want it shorter than the driver's default of 10 seconds, since the client
+// only waits 500ms for a server to be selected. Zero means the driver's
+// default.
+//
+// This method must be called before Connect to take effect.
+func (t *TestDB) SetHeartbeatInterval(d time.Duration) {
+	t.heartbeat = d
+}
+
+// SetReadConcern sets the default read concern of the TestDB's client, e.g.
+// readconcern.Majority() or readconcern.Snapshot() for tests of causal
+// consistency and snapshot reads. By default, the driver's default is used.
+//
+// This method must be called before Connect to take effect.
+func (t *TestDB) SetReadConcern(rc *readconcern.ReadConcern) {
+	t.readConcern = rc
+}
+
+// SetDirectConnection makes the TestDB's client connect directly to the single
+// host in its url instead of discovering the rest of the deployment. This is
+// needed to target a specific member of a replica set, e.g. a secondary. It's
+// off by default.
+//
+// This method must be called before Connect to take effect.
+func (t *TestDB) SetDirectConnection(enabled bool) {
+	t.direct = enabled
+}
+
+// SetOperationTimeout sets the client-side timeout of every operation run by
+// the TestDB's client, including ones whose context has no deadline. It's the
+// driver's Timeout option, so each operation, including any retries and the
+// time spent selecting a server, must finish within d. The connect timeout and
+// 500ms server selection timeout still apply on their own, so an operation can
+// fail sooner than d if no server is available. A context with an earlier
+// deadline still wins. Zero, the default, means no timeout.
+//
+// This method must be called before Connect to take effect.
+func (t *TestDB) SetOperationTimeout(d time.Duration) {
+	t.opTimeout = d
+}
+
+// SetAutoEncryptionOptions makes the TestDB's client automatically encrypt and
+// decrypt fields with client-side field level encryption, for end-to-end CSFLE
+// tests. Automatic encryption has prerequisites beyond the options: the test
+// binary must be built with the "cse" build tag against libmongocrypt, and
+// either mongocryptd must be on the PATH or the crypt_shared library must be
+// configured in opts. Without them, Connect fails.
+//
+// This method must be called before Connect to take effect.
+func (t *TestDB) SetAutoEncryptionOptions(opts *options.AutoEncryptionOptions) {
+	t.autoEncrypt = opts
+}
+
+// SetRetryWrites turns retryable writes on or off for the TestDB's client, e.g.
+// to check that code is idempotent when the driver doesn't retry for it. If
+// it's never called, the driver's default, which is on, is used.
+//
+// This method must be called before Connect to take effect.
+func (t *TestDB) SetRetryWrites(enabled bool) {
+	t.retryWrites = &enabled
+}
+
+// SetRetryReads is like SetRetryWrites, but for retryable reads.
+//
+// This method must be called before Connect to take effect.
+func (t *TestDB) SetRetryReads(enabled bool) {
+	t.retryReads = &enabled
+}
+
+// SetServerAPIVersion makes the TestDB's client use version v of MongoDB's
+// Stable API, e.g. "1", for tests that check code works when pinned to it. If
+// strict is true, the server rejects commands that aren't part of the API. An
+// error is returned if the driver doesn't support v.
+//
+// This method must be called before Connect to take effect.
+func (t *TestDB) SetServerAPIVersion(v string, strict bool) error {
+	version := options.ServerAPIVersion(v)
+	if err := version.Validate(); err != nil {
 		return err
 	}
+	t.serverAPI = options.ServerAPI(version).SetStrict(strict)
+	return nil
+}
+
+// SetPoolMonitor makes the TestDB's client send connection pool events, like
+// connections being created and checked out, to m. It can be combined with
+// SetRecordPoolEvents.
+//
+// This method must be called before Connect to take effect.
+func (t *TestDB) SetPoolMonitor(m *event.PoolMonitor) {
+	t.poolMonitor = m
+}
+
+// SetRecordPoolEvents makes the TestDB record the connection pool events of its
+// client, so tests of pooling behavior can read them with PoolEvents. It's off
+// by default, since recording every event has a cost.
+//
+// This method must be called before Connect to take effect.
+func (t *TestDB) SetRecordPoolEvents(enabled bool) {
+	t.recordPool = enabled
+}
+
+// PoolEvents returns the pool events recorded since Connect, oldest first, if
+// SetRecordPoolEvents turned recording on. If types are given, like
+// event.ConnectionCreated or event.GetSucceeded, only events of those types are
+// returned.
+func (t *TestDB) PoolEvents(types ...string) []event.PoolEvent {
+	t.poolMu.Lock()
+	defer t.poolMu.Unlock()
+
+	var events []event.PoolEvent
+	for _, e := range t.poolEvents {
+		if len(types) == 0 {
+			events = append(events, e)
+			continue
+		}
+		for _, typ := range types {
+			if e.Type == typ {
+				events = append(events, e)
+				break
+			}
+		}
+	}
+	return events
+}
+
+// SetMinServerVersion makes Connect fail if the MongoDB server is older than v,
+// which is a dotted version like "4.4" or "6.0.3". Suites that rely on newer
+// server features can use it to fail clearly at setup rather than obscurely
+// later on. Checking the version means Connect has to talk to the server, so
+// it will also fail if the server can't be reached.
+//
+// This method must be called before Connect to take effect.
+func (t *TestDB) SetMinServerVersion(v string) {
+	t.minServerVersion = v
+}
+
+// SetExplicitCreate makes CreateRandomCollection and friends always create
+// collections on the server right away. By default, a collection created with
+// NoIndexes isn't created until something is written to it, which surprises
+// tests that list collections or open change streams on it straight away.
+//
+// This method must be called before creating any collections to take effect.
+func (t *TestDB) SetExplicitCreate(enabled bool) {
+	t.explicitCreate = enabled
+}
+
+// defaultDropRetries is how many times a failed drop is retried unless
+// SetDropRetries says otherwise.
+const defaultDropRetries = 2
+
+// SetDropRetries sets how many times DropCollection and DropAll retry a drop
+// that fails transiently, with a short backoff between attempts. The default
+// is 2. Zero disables retries.
+func (t *TestDB) SetDropRetries(n int) {
+	t.dropRetries = n
+}
+
+// Connect initializes a connection to the TestDB. It will return an error if
+// it cannot connect to MongoDB. The error wraps ErrInvalidURI if the url is
+// invalid, or ErrConnect if the connection fails, so callers can tell the two
+// apart with errors.Is.
+func (t *TestDB) Connect() error {
+	opts := t.clientOptions()
+	if err := opts.Validate(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidURI, err)
+	}
 
 	// mongo.Connect() does not actually connect:
 	//   The Client.Connect method starts background goroutines to monitor the
@@ -106,91 +377,786 @@ func (t *TestDB) Connect() error {
 	// The caller must call client.Ping() to actually connect. Consequently,
 	// we don't need a context here. As long as there's not a bug in the mongo
 	// driver, this won't block.
-	if err := client.Connect(context.Background()); err != nil {
-		return err
+	client, err := mongo.Connect(context.Background(), opts)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrConnect, err)
 	}
 
 	t.client = client
+	t.appliedOpts = opts
+
+	if t.minServerVersion != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+		defer cancel()
+
+		version, err := t.ServerVersion(ctx)
+		if err != nil {
+			err = fmt.Errorf("%w: %w", ErrConnect, err)
+		} else {
+			err = versionAtLeast(version, t.minServerVersion)
+		}
+		if err != nil {
+			client.Disconnect(context.Background())
+			t.client = nil
+			t.appliedOpts = nil
+			return err
+		}
+	}
 	return nil
 }
 
+// ClientOptions returns the options the TestDB's client was created with, or,
+// if Connect hasn't been called yet, the options it would be created with. It
+// reflects the url, timeouts, env var overrides, and every other setting, which
+// helps when debugging misconfiguration. The returned options are a copy, so
+// changing them has no effect on the TestDB.
+func (t *TestDB) ClientOptions() *options.ClientOptions {
+	if t.appliedOpts != nil {
+		return options.MergeClientOptions(t.appliedOpts)
+	}
+	return t.clientOptions()
+}
+
+// Connected returns true if Connect has been called successfully on the TestDB.
+// Methods that configure the connection, like OverrideWithEnvVars, have no
+// effect once it returns true.
+func (t *TestDB) Connected() bool {
+	return t.client != nil
+}
+
 // CreateRandomCollection creates a collection with the details of info, and
 // ensures it has the provided indexes. The name of the collection will be
-// random, following the format of "test_" + 8 random characters. The
-// DropCollection method should always be called to clean up collections
-// created by this method.
+// random, following the format of "test_" + 8 random characters. Collections
+// created by this method should always be cleaned up, either one at a time
+// with DropCollection or all at once with DropAll.
 //
 // TestDB only supports creating random collections due to the fact that tests
 // run concurrently. If multiple tests used the same collection, they would
 // probably stomp on each other.
 func (t *TestDB) CreateRandomCollection(indexes []mongo.IndexModel) (*mongo.Collection, error) {
-	if t.client == nil {
-		return nil, fmt.Errorf("must call Connect first")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return t.CreateRandomCollectionContext(ctx, indexes)
+}
+
+// CreateRandomCollectionContext is like CreateRandomCollection, but it uses ctx
+// instead of a 10 second timeout. If ctx is already done, it returns ctx.Err()
+// without creating anything.
+func (t *TestDB) CreateRandomCollectionContext(ctx context.Context, indexes []mongo.IndexModel) (*mongo.Collection, error) {
+	return t.createRandomCollection(ctx, nil, "", indexes)
+}
+
+// CreateRandomCollectionHint is like CreateRandomCollection, but hint is put in
+// the collection's name, e.g. "test_orders_abcdefgh" for the hint "orders", so
+// leftover collections say what they were for. Characters that aren't ASCII
+// letters, digits, '_', or '-' are replaced with '_', and the hint is
+// truncated to 64 bytes. It has no effect when SetNameFunc is used.
+func (t *TestDB) CreateRandomCollectionHint(hint string, indexes []mongo.IndexModel) (*mongo.Collection, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return t.createRandomCollection(ctx, nil, hint, indexes)
+}
+
+// CreateRandomCollectionWithCleanup is like CreateRandomCollection, but it also
+// returns a function that drops the collection, bounded by the TestDB's
+// timeout, so callers that aren't using testing.TB cleanup can simply
+// "defer cleanup()". The function is safe to call more than once; only the
+// first call drops the collection. Errors from dropping it are ignored, and
+// DropAll will retry a drop that failed.
+func (t *TestDB) CreateRandomCollectionWithCleanup(indexes []mongo.IndexModel) (*mongo.Collection, func(), error) {
+	coll, err := t.CreateRandomCollection(indexes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var once sync.Once
+	cleanup := func() {
+		once.Do(func() {
+			ctx, cancel := t.Context()
+			defer cancel()
+			t.DropCollection(ctx, coll)
+		})
 	}
+	return coll, cleanup, nil
+}
 
+// CreateRandomCollectionWithValidator is like CreateRandomCollection, but the
+// collection is explicitly created with validator as its document validator,
+// e.g. a {"$jsonSchema": ...} document. Inserts and updates that don't satisfy
+// the validator will fail; IsValidationError can be used to check for that.
+func (t *TestDB) CreateRandomCollectionWithValidator(validator bson.M, indexes []mongo.IndexModel) (*mongo.Collection, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	collection := "test_" + randSeq(8)
-	coll := t.client.Database(t.db).Collection(collection)
+	opts := options.CreateCollection().SetValidator(validator)
+	return t.createRandomCollection(ctx, opts, "", indexes)
+}
 
-	if len(indexes) > 0 {
-		indexView := coll.Indexes()
+// CreateRandomCollectionWithOptions is like CreateRandomCollection, but the
+// collection is explicitly created with opts, for settings that don't have a
+// helper of their own, like a WiredTiger storage engine config:
+//
+//	opts := options.CreateCollection().SetStorageEngine(bson.M{
+//		"wiredTiger": bson.M{"configString": "block_compressor=zlib"},
+//	})
+//
+// Clustered collections, created with opts.SetClusteredIndex(ClusteredIndex()),
+// need MongoDB 5.3 or newer; on older servers, an error saying so is returned
+// without creating anything.
+func (t *TestDB) CreateRandomCollectionWithOptions(opts *options.CreateCollectionOptions, indexes []mongo.IndexModel) (*mongo.Collection, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if opts == nil {
+		opts = options.CreateCollection()
+	}
+	if opts.ClusteredIndex != nil {
+		if t.client == nil {
+			return nil, errNotConnected
+		}
+		err := t.checkServerVersion(ctx, clusteredIndexMinVersion)
+		var tooOld *serverTooOldError
+		if errors.As(err, &tooOld) {
+			return nil, fmt.Errorf("clustered collections require MongoDB %s or newer: %w", clusteredIndexMinVersion, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return t.createRandomCollection(ctx, opts, "", indexes)
+}
+
+// CreateRandomCappedCollection is like CreateRandomCollection, but the
+// collection is explicitly created as a capped collection of at most sizeBytes
+// bytes and, if maxDocs is greater than zero, at most maxDocs documents. Capped
+// collections are needed to test tailable cursors; see TailableCursor. An error
+// is returned if the server doesn't report the new collection as capped.
+func (t *TestDB) CreateRandomCappedCollection(sizeBytes, maxDocs int64) (*mongo.Collection, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	opts := options.CreateCollection().SetCapped(true).SetSizeInBytes(sizeBytes)
+	if maxDocs > 0 {
+		opts.SetMaxDocuments(maxDocs)
+	}
+	coll, err := t.createRandomCollection(ctx, opts, "", NoIndexes)
+	if err != nil {
+		return nil, err
+	}
+
+	stats, err := t.CollectionStats(ctx, coll)
+	if err == nil && stats["capped"] != true {
+		err = fmt.Errorf("collection %s.%s was not created as a capped collection", coll.Database().Name(), coll.Name())
+	}
+	if err != nil {
+		t.DropCollection(ctx, coll)
+		return nil, err
+	}
+	return coll, nil
+}
+
+// createRandomCollection creates a random collection with the provided indexes,
+// with hint in its name if it isn't empty. If createOpts isn't nil, or the
+// TestDB is set to always create collections explicitly, the collection is
+// explicitly created first; otherwise it's left to be created implicitly.
+func (t *TestDB) createRandomCollection(ctx context.Context, createOpts *options.CreateCollectionOptions, hint string, indexes []mongo.IndexModel) (*mongo.Collection, error) {
+	if t.client == nil {
+		return nil, errNotConnected
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-		opts := options.CreateIndexes().SetMaxTime(2 * time.Second)
-		if _, err := indexView.CreateMany(ctx, indexes, opts); err != nil {
-			coll.Drop(ctx)
+	start := time.Now()
+	defer func() {
+		t.mu.Lock()
+		t.lastSetup = time.Since(start)
+		t.mu.Unlock()
+	}()
+
+	db := t.client.Database(t.database())
+	collection, err := t.collectionName(db.Name(), hint)
+	if err != nil {
+		return nil, err
+	}
+	if createOpts == nil && t.explicitCreate {
+		createOpts = options.CreateCollection()
+	}
+	if createOpts != nil {
+		if err := db.CreateCollection(ctx, collection, createOpts); err != nil {
 			return nil, err
 		}
 	}
+	coll := db.Collection(collection)
 
+	if err := t.EnsureIndexes(ctx, coll, indexes); err != nil {
+		// ctx may be why creating the indexes failed, so don't use it to
+		// clean up.
+		dropCtx, cancel := t.Context()
+		coll.Drop(dropCtx)
+		cancel()
+		return nil, err
+	}
+
+	t.track(coll)
 	return coll, nil
 }
 
+// CollectionInfo describes a collection created by a TestDB.
+type CollectionInfo struct {
+	DB   string
+	Name string
+
+	// Indexes are the sorted names of the indexes on the collection, including
+	// the default "_id_" index. Unless SetExplicitCreate is used, a collection
+	// created without indexes doesn't exist on the server until something is
+	// written to it, so its Indexes will be empty.
+	Indexes []string
+}
+
+// CreateRandomCollectionInfo is like CreateRandomCollection, but it also
+// returns a CollectionInfo describing what was created. This is useful for
+// logging and asserting on the setup of tests that create many collections.
+func (t *TestDB) CreateRandomCollectionInfo(indexes []mongo.IndexModel) (*mongo.Collection, CollectionInfo, error) {
+	coll, err := t.CreateRandomCollection(indexes)
+	if err != nil {
+		return nil, CollectionInfo{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	names, err := IndexNames(ctx, coll, true)
+	if err != nil {
+		t.DropCollection(ctx, coll)
+		return nil, CollectionInfo{}, err
+	}
+
+	info := CollectionInfo{
+		DB:      coll.Database().Name(),
+		Name:    coll.Name(),
+		Indexes: names,
+	}
+	return coll, info, nil
+}
+
+// waitForCollectionInterval is how often WaitForCollection checks whether the
+// collection exists.
+const waitForCollectionInterval = 50 * time.Millisecond
+
+// WaitForCollection blocks until a collection called name exists in the
+// TestDB's current database, or until ctx is done, in which case it returns
+// ctx.Err(). In sharded and other eventually consistent setups, a collection
+// may not be visible everywhere immediately after it's created.
+func (t *TestDB) WaitForCollection(ctx context.Context, name string) error {
+	if t.client == nil {
+		return errNotConnected
+	}
+
+	db := t.client.Database(t.database())
+	err := Eventually(ctx, waitForCollectionInterval, func() (bool, error) {
+		names, err := db.ListCollectionNames(ctx, bson.M{"name": name})
+		return len(names) > 0, err
+	})
+	if err != nil && ctx.Err() != nil {
+		// The driver's error for a listing cut short by ctx wraps ctx.Err()
+		// in its own, which is less useful.
+		return ctx.Err()
+	}
+	return err
+}
+
+// CountCollectionsByPrefix returns how many collections in the TestDB's current
+// database have names starting with prefix, not counting system collections.
+// CI can use it to keep an eye on leftover test collections, e.g. with the
+// "test_" prefix used for random collections.
+func (t *TestDB) CountCollectionsByPrefix(ctx context.Context, prefix string) (int, error) {
+	if t.client == nil {
+		return 0, errNotConnected
+	}
+
+	filter := bson.M{"name": bson.M{"$regex": "^" + regexp.QuoteMeta(prefix)}}
+	names, err := t.client.Database(t.database()).ListCollectionNames(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, name := range names {
+		if !strings.HasPrefix(name, "system.") {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// FindOrphans returns the names of the collections starting with prefix in
+// every database on the server, keyed by database name, not counting system
+// collections or the admin, config, and local databases. Databases without any
+// matching collections are left out. It gives a cluster-wide view of leftover
+// test collections, which CountCollectionsByPrefix only gives for one database.
+func (t *TestDB) FindOrphans(ctx context.Context, prefix string) (map[string][]string, error) {
+	if t.client == nil {
+		return nil, errNotConnected
+	}
+
+	dbs, err := t.client.ListDatabaseNames(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+
+	filter := bson.M{"name": bson.M{"$regex": "^" + regexp.QuoteMeta(prefix)}}
+	orphans := map[string][]string{}
+	for _, db := range dbs {
+		switch db {
+		case "admin", "config", "local":
+			continue
+		}
+
+		names, err := t.client.Database(db).ListCollectionNames(ctx, filter)
+		if err != nil {
+			return nil, fmt.Errorf("listing collections in %s: %w", db, err)
+		}
+		for _, name := range names {
+			if !strings.HasPrefix(name, "system.") {
+				orphans[db] = append(orphans[db], name)
+			}
+		}
+	}
+	return orphans, nil
+}
+
+// UseDatabase switches the database that the TestDB creates collections in and
+// runs commands against. Collections that were already created stay where they
+// are, and are still dropped by DropAll. This lets one TestDB, and its
+// connection, be used for tests that span multiple databases.
+func (t *TestDB) UseDatabase(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.db = name
+}
+
+// DropCollection drops coll and stops tracking it, so DropAll won't try to drop
+// it again. The driver's error is returned as-is.
+func (t *TestDB) DropCollection(ctx context.Context, coll *mongo.Collection) error {
+	if err := t.dropCollection(ctx, coll); err != nil {
+		return err
+	}
+	t.untrack(coll)
+	return nil
+}
+
+// RenameCollection renames coll to newName in the same database, replacing any
+// existing collection called newName if dropTarget is true, and returns a
+// handle to the renamed collection. If coll was created by the TestDB, the
+// TestDB tracks it under its new name, so DropAll still cleans it up, and a
+// replaced collection that the TestDB created counts as dropped. Errors from
+// the command are returned as-is.
+func (t *TestDB) RenameCollection(ctx context.Context, coll *mongo.Collection, newName string, dropTarget bool) (*mongo.Collection, error) {
+	if t.client == nil {
+		return nil, errNotConnected
+	}
+	db := coll.Database()
+	if err := validateCollectionName(db.Name(), newName); err != nil {
+		return nil, err
+	}
+
+	cmd := bson.D{
+		{Key: "renameCollection", Value: db.Name() + "." + coll.Name()},
+		{Key: "to", Value: db.Name() + "." + newName},
+		{Key: "dropTarget", Value: dropTarget},
+	}
+	if _, err := t.RunAdminCommand(ctx, cmd); err != nil {
+		return nil, err
+	}
+
+	renamed := db.Collection(newName)
+	if dropTarget {
+		// The server dropped the previous target, which the TestDB may have
+		// created.
+		t.untrack(renamed)
+	}
+	t.retrack(coll, renamed)
+	return renamed, nil
+}
+
+// CreateRandomDatabase returns a database with a random name, following the
+// same format as the names of random collections. Like collections, databases
+// aren't created on the server until something is written to them. DropAll
+// drops the database along with everything in it.
+//
+// The TestDB keeps creating collections in its current database; use
+// UseDatabase to switch to the new one.
+func (t *TestDB) CreateRandomDatabase() (*mongo.Database, error) {
+	if t.client == nil {
+		return nil, errNotConnected
+	}
+
+	db := t.client.Database("test_" + t.randSeq(8))
+	t.trackDatabase(db.Name())
+	return db, nil
+}
+
+// DropAll drops every collection and database created by the TestDB, across
+// all databases it has used, so teardown is a single call. It attempts every
+// drop even if some fail, and returns all of the errors encountered, joined
+// with errors.Join so that each names what failed to drop and errors.Is and
+// errors.As can check for any of their causes. Anything that fails to drop is
+// still tracked, so calling DropAll again retries it.
+//
+// Collections that were already dropped, e.g. by calling Drop on the handle
+// returned from CreateRandomCollection, are skipped without an error, so DropAll
+// can be used alongside manual cleanup.
+func (t *TestDB) DropAll(ctx context.Context) error {
+	return t.dropAll(ctx, 0)
+}
+
+// dropAll implements DropAll. If perDrop is greater than zero, each drop is
+// also bounded by it.
+func (t *TestDB) dropAll(ctx context.Context, perDrop time.Duration) error {
+	if t.client == nil {
+		return errNotConnected
+	}
+	dropCtx := func() (context.Context, context.CancelFunc) {
+		if perDrop > 0 {
+			return context.WithTimeout(ctx, perDrop)
+		}
+		return context.WithCancel(ctx)
+	}
+
+	// Drop a snapshot of what's tracked rather than holding mu across the
+	// network calls, which would block every other use of the TestDB until
+	// the drops finish.
+	t.mu.Lock()
+	var colls []*mongo.Collection
+	for db, names := range t.collections {
+		if _, ok := t.databases[db]; ok {
+			// Dropped along with the database below.
+			continue
+		}
+		for name := range names {
+			colls = append(colls, t.client.Database(db).Collection(name))
+		}
+	}
+	dbs := make([]string, 0, len(t.databases))
+	for db := range t.databases {
+		dbs = append(dbs, db)
+	}
+	t.mu.Unlock()
+
+	var errs []error
+	for _, coll := range colls {
+		dctx, cancel := dropCtx()
+		err := t.dropCollection(dctx, coll)
+		cancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("dropping collection %s.%s: %w", coll.Database().Name(), coll.Name(), err))
+			continue
+		}
+		t.untrack(coll)
+	}
+	for _, db := range dbs {
+		dctx, cancel := dropCtx()
+		err := t.retryDrop(dctx, t.client.Database(db).Drop)
+		cancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("dropping database %s: %w", db, err))
+			continue
+		}
+		t.untrackDatabase(db)
+	}
+	return errors.Join(errs...)
+}
+
+// LastSetupDuration returns how long the TestDB's most recent attempt to create
+// a random collection took, including creating its indexes, whether or not it
+// succeeded. Logging it helps diagnose slow or flaky CI, e.g. an overloaded
+// cluster taking seconds to build indexes. It's zero until the first attempt.
+func (t *TestDB) LastSetupDuration() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lastSetup
+}
+
+// CreatedCount returns how many collections the TestDB has created.
+func (t *TestDB) CreatedCount() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.created
+}
+
+// DroppedCount returns how many of the collections created by the TestDB have
+// been dropped through DropCollection or DropAll. Suites can compare it to
+// CreatedCount at the end to check that they aren't leaking collections.
+func (t *TestDB) DroppedCount() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.dropped
+}
+
+// StartSession starts a session on the TestDB's client, e.g. one with
+// options.Session().SetCausalConsistency(true) for testing read-your-writes
+// guarantees. The caller must end the session with EndSession when done with
+// it. Connect must be called first.
+func (t *TestDB) StartSession(opts ...*options.SessionOptions) (mongo.Session, error) {
+	if t.client == nil {
+		return nil, errNotConnected
+	}
+	return t.client.StartSession(opts...)
+}
+
 // Close terminates the TestDB's connection to MongoDB.
 func (t *TestDB) Close() {
 	t.client.Disconnect(context.Background())
 }
 
-const dupeKeyCode = 11000
-
-// IsDupeKeyError returns true if the error is a Mongo duplicate key error.
-func IsDupeKeyError(err error) bool {
-	// mongo.WriteException{
-	//   WriteConcernError:(*mongo.WriteConcernError)(nil),
-	//   WriteErrors:mongo.WriteErrors{
-	//     mongo.WriteError{
-	//       Index:0,
-	//       Code:11000,
-	//       Message:"E11000 duplicate key error collection: coll.nodes index: x_1 dup key: { : 6 }"
-	//     }
-	//   }
-	// }
-	if _, ok := err.(mongo.WriteException); ok {
-		we := err.(mongo.WriteException)
-		for _, e := range we.WriteErrors {
-			if e.Code == dupeKeyCode {
-				return true
+// CloseContext is like Close, but it first drops everything created by the
+// TestDB, like DropAll, so teardown is a single call. Each drop is bounded by
+// the TestDB's timeout as well as ctx, so a slow server can't hang teardown.
+// The connection is terminated even if some drops fail, and the returned error
+// joins the errors from every failed drop and from disconnecting, the same way
+// DropAll does.
+func (t *TestDB) CloseContext(ctx context.Context) error {
+	if t.client == nil {
+		return errNotConnected
+	}
+
+	var errs []error
+	if err := t.dropAll(ctx, t.timeout); err != nil {
+		errs = append(errs, err)
+	}
+	if err := t.client.Disconnect(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("disconnecting: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// ------------------------------------------------------------------------- //
+
+// clientOptions builds the options for the TestDB's client from its settings.
+func (t *TestDB) clientOptions() *options.ClientOptions {
+	// SetServerSelectionTimeout is different and more important than SetConnectTimeout.
+	// Internally, the mongo driver is polling and updating the topology,
+	// i.e. the list of replicas/nodes in the cluster. SetServerSelectionTimeout
+	// applies to selecting a node from the topology, which should be nearly
+	// instantaneous when the cluster is ok _and_ when it's down. When a node
+	// is down, it's reflected in the topology, so there's no need to wait for
+	// another server because we only use one server: the master replica.
+	// The 500ms below is really how long the driver will wait for the master
+	// replica to come back online.
+	//
+	// SetConnectTimeout is what is seems: timeout when a connection is actually
+	// made. This guards against slows networks, or the case when the mongo driver
+	// thinks the master is online but really it's not.
+	opts := options.Client().
+		ApplyURI(t.url).
+		SetConnectTimeout(t.timeout).
+		SetServerSelectionTimeout(time.Duration(500 * time.Millisecond))
+	if t.logger != nil {
+		opts.SetLoggerOptions(t.logger)
+	}
+	if t.registry != nil {
+		opts.SetRegistry(t.registry)
+	}
+	if t.maxPoolSize > 0 {
+		opts.SetMaxPoolSize(t.maxPoolSize)
+	}
+	if len(t.compressors) > 0 {
+		opts.SetCompressors(t.compressors)
+	}
+	if t.heartbeat > 0 {
+		opts.SetHeartbeatInterval(t.heartbeat)
+	}
+	if t.readConcern != nil {
+		opts.SetReadConcern(t.readConcern)
+	}
+	if t.direct {
+		opts.SetDirect(true)
+	}
+	if t.opTimeout > 0 {
+		opts.SetTimeout(t.opTimeout)
+	}
+	if t.autoEncrypt != nil {
+		opts.SetAutoEncryptionOptions(t.autoEncrypt)
+	}
+	if t.retryWrites != nil {
+		opts.SetRetryWrites(*t.retryWrites)
+	}
+	if t.retryReads != nil {
+		opts.SetRetryReads(*t.retryReads)
+	}
+	if t.serverAPI != nil {
+		opts.SetServerAPIOptions(t.serverAPI)
+	}
+	if t.recordPool {
+		user := t.poolMonitor
+		opts.SetPoolMonitor(&event.PoolMonitor{
+			Event: func(e *event.PoolEvent) {
+				t.poolMu.Lock()
+				t.poolEvents = append(t.poolEvents, *e)
+				t.poolMu.Unlock()
+				if user != nil && user.Event != nil {
+					user.Event(e)
+				}
+			},
+		})
+	} else if t.poolMonitor != nil {
+		opts.SetPoolMonitor(t.poolMonitor)
+	}
+
+	return opts
+}
+
+// database returns the name of the database currently in use.
+func (t *TestDB) database() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.db
+}
+
+// track records that the TestDB created coll so that DropAll can clean it up.
+func (t *TestDB) track(coll *mongo.Collection) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	db := coll.Database().Name()
+	if t.collections == nil {
+		t.collections = map[string]map[string]struct{}{}
+	}
+	if t.collections[db] == nil {
+		t.collections[db] = map[string]struct{}{}
+	}
+	t.collections[db][coll.Name()] = struct{}{}
+	t.created++
+}
+
+// tracked returns true if coll was created by the TestDB and hasn't been
+// dropped since.
+func (t *TestDB) tracked(coll *mongo.Collection) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	_, ok := t.collections[coll.Database().Name()][coll.Name()]
+	return ok
+}
+
+// retrack makes the TestDB track to instead of from, once from has been renamed
+// to to, without changing the counts. It's a no-op if from isn't tracked.
+func (t *TestDB) retrack(from, to *mongo.Collection) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	db := from.Database().Name()
+	if _, ok := t.collections[db][from.Name()]; !ok {
+		return
+	}
+	delete(t.collections[db], from.Name())
+	t.collections[db][to.Name()] = struct{}{}
+}
+
+// untrack stops tracking coll, once it's been dropped.
+func (t *TestDB) untrack(coll *mongo.Collection) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	db := coll.Database().Name()
+	if _, ok := t.collections[db][coll.Name()]; !ok {
+		return
+	}
+	delete(t.collections[db], coll.Name())
+	t.dropped++
+	if len(t.collections[db]) == 0 {
+		delete(t.collections, db)
+	}
+}
+
+// trackDatabase records that the TestDB created the database called name so
+// that DropAll can clean it up.
+func (t *TestDB) trackDatabase(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.databases == nil {
+		t.databases = map[string]struct{}{}
+	}
+	t.databases[name] = struct{}{}
+}
+
+// untrackDatabase stops tracking the database called name, and the collections
+// in it, once it's been dropped.
+func (t *TestDB) untrackDatabase(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.databases, name)
+	t.dropped += len(t.collections[name])
+	delete(t.collections, name)
+}
+
+// dropCollection drops coll, treating a collection that doesn't exist, because
+// it was never materialized or was already dropped, as success.
+func (t *TestDB) dropCollection(ctx context.Context, coll *mongo.Collection) error {
+	return t.retryDrop(ctx, coll.Drop)
+}
+
+// dropRetryBackoff is how long retryDrop waits after the first failed attempt.
+// It waits twice as long after the second, and so on.
+const dropRetryBackoff = 100 * time.Millisecond
+
+// retryDrop calls drop until it succeeds, up to 1 + the TestDB's drop retries
+// times. Drops can fail transiently on sharded clusters, which would otherwise
+// leave orphaned collections behind. NamespaceNotFound counts as success, and
+// errors that aren't transient, like not being authorized, are returned
+// without retrying, as is the last error if ctx is done during the backoff.
+func (t *TestDB) retryDrop(ctx context.Context, drop func(context.Context) error) error {
+	var err error
+	for attempt := 0; attempt <= t.dropRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(dropRetryBackoff << (attempt - 1)):
 			}
 		}
-	}
-	if _, ok := err.(mongo.CommandError); ok {
-		ce := err.(mongo.CommandError)
-		if ce.Code == dupeKeyCode {
-			return true
+
+		err = drop(ctx)
+		if err == nil || isNamespaceNotFound(err) {
+			return nil
+		}
+		if !isTransient(err) {
+			return err
 		}
 	}
-	return false
+	return err
 }
 
-// ------------------------------------------------------------------------- //
+// writerSink is an options.LogSink that writes one line per log message to an
+// io.Writer.
+type writerSink struct {
+	w  io.Writer
+	mu sync.Mutex
+}
 
-var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+func (s *writerSink) Info(level int, message string, keysAndValues ...interface{}) {
+	s.write(message, "", keysAndValues)
+}
 
-func randSeq(n int) string {
-	b := make([]rune, n)
-	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
+func (s *writerSink) Error(err error, message string, keysAndValues ...interface{}) {
+	s.write(message, fmt.Sprintf(" error=%q", err), keysAndValues)
+}
+
+func (s *writerSink) write(message, errField string, keysAndValues []interface{}) {
+	var b strings.Builder
+	b.WriteString(message)
+	b.WriteString(errField)
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", keysAndValues[i], keysAndValues[i+1])
 	}
-	return string(b)
+	b.WriteString("\n")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	io.WriteString(s.w, b.String())
 }
@@ -0,0 +1,452 @@
+package testdb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// availabilityTimeout bounds how long SkipIfUnavailable waits for MongoDB. It's
+// independent of the TestDB's timeout so that a missing server is detected
+// quickly even if the TestDB is configured to be patient.
+const availabilityTimeout = 1 * time.Second
+
+// SkipIfUnavailable skips tb if the TestDB's MongoDB instance can't be reached.
+// It makes a separate short-lived connection and pings the server, so it can be
+// called whether or not Connect has been called. This is useful for suites that
+// should skip, rather than fail, when no MongoDB is running.
+func (t *TestDB) SkipIfUnavailable(tb testing.TB) {
+	tb.Helper()
+
+	opts := options.Client().
+		ApplyURI(t.url).
+		SetConnectTimeout(availabilityTimeout).
+		SetServerSelectionTimeout(availabilityTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), availabilityTimeout)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		tb.Skipf("skipping test: MongoDB at %q is unavailable: %s", t.url, err)
+	}
+	defer client.Disconnect(context.Background())
+
+	if err := client.Ping(ctx, nil); err != nil {
+		tb.Skipf("skipping test: MongoDB at %q is unavailable: %s", t.url, err)
+	}
+}
+
+// RequireDupeKey fails tb immediately if err isn't a duplicate key error.
+func RequireDupeKey(tb testing.TB, err error) {
+	tb.Helper()
+	if !IsDupeKeyError(err) {
+		tb.Fatalf("expected a duplicate key error, got: %v", err)
+	}
+}
+
+// RequireNotDupeKey fails tb immediately if err is a duplicate key error. A nil
+// error, or one for any other reason, passes.
+func RequireNotDupeKey(tb testing.TB, err error) {
+	tb.Helper()
+	if IsDupeKeyError(err) {
+		tb.Fatalf("expected no duplicate key error, got: %v", err)
+	}
+}
+
+// AssertUniqueEnforced inserts doc into coll twice and fails tb immediately
+// unless the second insert is rejected as a duplicate key. It checks that a
+// unique index actually enforces uniqueness rather than only that one exists.
+//
+// doc shouldn't have an _id, or the second insert will be rejected because of
+// the _id rather than the index. The first copy of doc is left in coll.
+func AssertUniqueEnforced(tb testing.TB, coll *mongo.Collection, doc interface{}) {
+	tb.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := coll.InsertOne(ctx, doc); err != nil {
+		tb.Fatalf("inserting the first copy of the document: %s", err)
+	}
+	_, err := coll.InsertOne(ctx, doc)
+	if err == nil {
+		tb.Fatalf("expected inserting the document twice to fail with a duplicate key error, but it succeeded")
+	}
+	if !IsDupeKeyError(err) {
+		tb.Fatalf("expected inserting the document twice to fail with a duplicate key error, got: %v", err)
+	}
+}
+
+// maxDatabaseNameLen is the longest a database name can be.
+const maxDatabaseNameLen = 63
+
+// IsolateDatabase switches the TestDB to a new database just for tb, named
+// after the test plus a random suffix, e.g. "TestFoo_bar_kXjQwPzR", so it's
+// easy to tell which test left data behind. The database is dropped when tb
+// finishes, and the TestDB switches back to the database it was using before.
+// It must be called before the test creates any collections, since collections
+// created earlier stay in the previous database.
+//
+// Because this changes the database of the whole TestDB, don't share the
+// TestDB with tests running in parallel.
+func (t *TestDB) IsolateDatabase(tb testing.TB) {
+	tb.Helper()
+	if t.client == nil {
+		tb.Fatalf("isolating database: %s", errNotConnected)
+	}
+
+	suffix := "_" + t.randSeq(8)
+	name := sanitizeName(tb.Name(), maxDatabaseNameLen-len(suffix)) + suffix
+	db := t.client.Database(name)
+
+	prev := t.database()
+	t.trackDatabase(name)
+	t.UseDatabase(name)
+
+	tb.Cleanup(func() {
+		t.UseDatabase(prev)
+
+		ctx, cancel := t.Context()
+		defer cancel()
+
+		if err := t.retryDrop(ctx, db.Drop); err != nil {
+			tb.Errorf("dropping database %s: %s", name, err)
+			return
+		}
+		t.untrackDatabase(name)
+	})
+}
+
+// CreateRandomCollectionT is like CreateRandomCollection, but it fails tb
+// immediately if the collection can't be created, and drops the collection
+// when tb finishes. Creating the collection is bounded by the TestDB's timeout
+// and, if tb has one, like a *testing.T, by tb's deadline too, whichever comes
+// first, so setup can't outlive the test.
+func (t *TestDB) CreateRandomCollectionT(tb testing.TB, indexes []mongo.IndexModel) *mongo.Collection {
+	tb.Helper()
+
+	// Bound setup by tb's deadline, if it has one, and by the TestDB's
+	// timeout, whichever comes first.
+	ctx, cancel := t.Context()
+	defer cancel()
+	if d, ok := tb.(interface{ Deadline() (time.Time, bool) }); ok {
+		if deadline, ok := d.Deadline(); ok {
+			var cancelDeadline context.CancelFunc
+			ctx, cancelDeadline = context.WithDeadline(ctx, deadline)
+			defer cancelDeadline()
+		}
+	}
+
+	coll, err := t.createRandomCollection(ctx, nil, "", indexes)
+	if err != nil {
+		tb.Fatalf("creating random collection: %s", err)
+		return nil
+	}
+
+	tb.Cleanup(func() {
+		ctx, cancel := t.Context()
+		defer cancel()
+
+		if err := t.DropCollection(ctx, coll); err != nil {
+			tb.Errorf("dropping collection %s.%s: %s", coll.Database().Name(), coll.Name(), err)
+		}
+	})
+	return coll
+}
+
+// Setup returns a new random collection with the provided indexes for tb,
+// which is dropped when tb finishes. The first time it's called, it applies
+// OverrideWithEnvVars and connects the TestDB, so a test suite can share one
+// TestDB and set up each test with a single line:
+//
+//	coll := testDb.Setup(t, testdb.NoIndexes)
+//
+// Any error fails tb immediately. The TestDB stays connected after tb finishes
+// so other tests can use it; call Close when the suite is done, e.g. in
+// TestMain. Because connecting isn't synchronized, the first call mustn't be
+// made from tests running in parallel.
+func (t *TestDB) Setup(tb testing.TB, indexes []mongo.IndexModel) *mongo.Collection {
+	tb.Helper()
+
+	if !t.Connected() {
+		t.OverrideWithEnvVars()
+		if err := t.Connect(); err != nil {
+			tb.Fatalf("connecting to MongoDB: %s", err)
+			return nil
+		}
+	}
+	return t.CreateRandomCollectionT(tb, indexes)
+}
+
+// Eventually calls fn every interval until it returns true, and returns nil.
+// It's for assertions on state that changes in the background, like a
+// collection being populated by another process. If fn returns an error,
+// Eventually stops and returns it. If ctx is done first, it returns ctx.Err().
+// fn is called once right away, and interval must be greater than zero.
+func Eventually(ctx context.Context, interval time.Duration, fn func() (bool, error)) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid interval %s: must be greater than zero", interval)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		done, err := fn()
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+var (
+	sharedMu sync.Mutex // guards shared
+	shared   *TestDB
+)
+
+// Shared returns a TestDB that's shared by every caller in the test binary,
+// connecting it on the first call, so a suite can connect once in TestMain
+// instead of in every test. Like Setup, it applies OverrideWithEnvVars before
+// connecting. Once it's connected, later calls return the same TestDB and
+// ignore their arguments. If connecting fails, the error is returned and the
+// next call tries again. It's safe to call from tests running in parallel.
+func Shared(url, db string, timeout time.Duration) (*TestDB, error) {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+
+	if shared != nil {
+		return shared, nil
+	}
+	t := NewTestDB(url, db, timeout)
+	t.OverrideWithEnvVars()
+	if err := t.Connect(); err != nil {
+		return nil, err
+	}
+	shared = t
+	return shared, nil
+}
+
+// ShutdownShared drops everything created by the shared TestDB and closes it,
+// like CloseContext, e.g. at the end of TestMain. The next call to Shared
+// connects a new TestDB. It's a no-op if there's no shared TestDB.
+func ShutdownShared() error {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+
+	if shared == nil {
+		return nil
+	}
+	ctx, cancel := shared.Context()
+	defer cancel()
+
+	err := shared.CloseContext(ctx)
+	shared = nil
+	return err
+}
+
+// AssertDocEqual fails tb immediately unless got and want are the same document
+// once the ignore fields are removed from both, e.g. "_id" or "updatedAt".
+// Ignored fields can be dotted paths into embedded documents, like
+// "meta.version". Values are compared as BSON, so an int and an int32 holding
+// the same number are equal. The order of fields in embedded documents is
+// ignored, but the order of array elements isn't. The failure message lists
+// every field that differs.
+func AssertDocEqual(tb testing.TB, got, want bson.M, ignore ...string) {
+	tb.Helper()
+
+	got, want = withoutFields(got, ignore), withoutFields(want, ignore)
+	keys := make([]string, 0, len(got)+len(want))
+	for k := range got {
+		keys = append(keys, k)
+	}
+	for k := range want {
+		if _, ok := got[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var diffs []string
+	for _, k := range keys {
+		g, inGot := got[k]
+		w, inWant := want[k]
+		switch {
+		case !inGot:
+			diffs = append(diffs, fmt.Sprintf("%s: missing, want %v", k, w))
+		case !inWant:
+			diffs = append(diffs, fmt.Sprintf("%s: got %v, want no such field", k, g))
+		case !bsonEqual(g, w):
+			diffs = append(diffs, fmt.Sprintf("%s: got %v (%T), want %v (%T)", k, g, g, w, w))
+		}
+	}
+	if len(diffs) > 0 {
+		tb.Fatalf("documents differ:\n\t%s", strings.Join(diffs, "\n\t"))
+	}
+}
+
+// withoutFields returns a copy of doc without the fields at paths, which may be
+// dotted paths into embedded documents. Embedded documents are only copied
+// when a field is removed from them.
+func withoutFields(doc bson.M, paths []string) bson.M {
+	out := make(bson.M, len(doc))
+	for k, v := range doc {
+		out[k] = v
+	}
+	for _, path := range paths {
+		head, rest, nested := strings.Cut(path, ".")
+		if !nested {
+			delete(out, head)
+			continue
+		}
+		if sub, ok := out[head].(bson.M); ok {
+			out[head] = withoutFields(sub, []string{rest})
+		}
+	}
+	return out
+}
+
+// bsonEqual reports whether a and b marshal to the same BSON value, ignoring
+// the order of fields in embedded documents, since maps like bson.M don't
+// have one.
+func bsonEqual(a, b interface{}) bool {
+	ab, aErr := bson.Marshal(bson.D{{Key: "v", Value: canonicalValue(a)}})
+	bb, bErr := bson.Marshal(bson.D{{Key: "v", Value: canonicalValue(b)}})
+	if aErr != nil || bErr != nil {
+		return reflect.DeepEqual(a, b)
+	}
+	return bytes.Equal(ab, bb)
+}
+
+// AssertCollectionScan fails tb immediately unless the server's winning plan
+// for a find on coll with filter is a collection scan (COLLSCAN), e.g. to check
+// that a query has no index to support it. On a sharded cluster, the winning
+// plan on every shard must be one. It's built on Explain, and the failure
+// message lists the stages of the actual winning plan.
+func AssertCollectionScan(tb testing.TB, coll *mongo.Collection, filter interface{}) {
+	tb.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	res, err := Explain(ctx, coll, filter)
+	if err != nil {
+		tb.Fatalf("explaining the query: %s", err)
+		return
+	}
+	planner, _ := res["queryPlanner"].(bson.M)
+	plans, err := winningPlanStages(planner)
+	if err != nil {
+		tb.Fatalf("explaining the query: %s", err)
+		return
+	}
+	for _, plan := range plans {
+		if !containsString(plan.stages, "COLLSCAN") {
+			where := "the winning plan"
+			if plan.shard != "" {
+				where += " on shard " + plan.shard
+			}
+			tb.Fatalf("expected %s to be a COLLSCAN, got stages %s", where, strings.Join(plan.stages, " > "))
+			return
+		}
+	}
+}
+
+// shardPlan holds the stages of the winning plan on one shard, or of the only
+// winning plan if the collection isn't sharded, in which case shard is empty.
+type shardPlan struct {
+	shard  string
+	stages []string
+}
+
+// winningPlanStages returns the stages of the winning plans in an explain
+// result's queryPlanner. On a sharded cluster, each shard has its own winning
+// plan. It returns an error if it doesn't recognize the layout, rather than
+// finding no stages.
+func winningPlanStages(planner bson.M) ([]shardPlan, error) {
+	plan, _ := planner["winningPlan"].(bson.M)
+	if plan == nil {
+		return nil, fmt.Errorf("unsupported explain layout: no winningPlan in %v", planner)
+	}
+
+	var plans []shardPlan
+	if shards, ok := plan["shards"].(bson.A); ok {
+		for _, s := range shards {
+			shard, _ := s.(bson.M)
+			name, _ := shard["shardName"].(string)
+			winning, _ := shard["winningPlan"].(bson.M)
+			plans = append(plans, shardPlan{shard: name, stages: planStages(unnestPlan(winning))})
+		}
+	} else {
+		plans = append(plans, shardPlan{stages: planStages(unnestPlan(plan))})
+	}
+
+	if len(plans) == 0 {
+		return nil, fmt.Errorf("unsupported explain layout: no shards in %v", plan)
+	}
+	for _, p := range plans {
+		if len(p.stages) == 0 {
+			return nil, fmt.Errorf("unsupported explain layout: no stages in %v", plan)
+		}
+	}
+	return plans, nil
+}
+
+// unnestPlan returns the plan of stages in a winning plan. Plans for the
+// slot-based execution engine nest the stages one level deeper.
+func unnestPlan(plan bson.M) bson.M {
+	if qp, ok := plan["queryPlan"].(bson.M); ok {
+		return qp
+	}
+	return plan
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// planStages returns the names of the stages of an explained plan, from the
+// root down.
+func planStages(plan bson.M) []string {
+	if plan == nil {
+		return nil
+	}
+	var stages []string
+	if stage, ok := plan["stage"].(string); ok {
+		stages = append(stages, stage)
+	}
+	if input, ok := plan["inputStage"].(bson.M); ok {
+		stages = append(stages, planStages(input)...)
+	}
+	if inputs, ok := plan["inputStages"].(bson.A); ok {
+		for _, input := range inputs {
+			if m, ok := input.(bson.M); ok {
+				stages = append(stages, planStages(m)...)
+			}
+		}
+	}
+	return stages
+}
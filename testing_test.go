@@ -0,0 +1,438 @@
+package testdb_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mongo-go/testdb"
+)
+
+func TestSkipIfUnavailable(t *testing.T) {
+	testDb := testdb.NewTestDB("mongodb://localhost:1", "test", defaultTimeout)
+
+	ran := false
+	t.Run("unavailable", func(t *testing.T) {
+		testDb.SkipIfUnavailable(t)
+		ran = true
+	})
+	if ran {
+		t.Error("expected the subtest to be skipped, but it ran to completion")
+	}
+}
+
+// fakeTB is a testing.TB that records failures instead of stopping the test, so
+// the failure paths of helpers can be tested.
+type fakeTB struct {
+	testing.TB
+	failed bool
+	msg    string
+}
+
+func (f *fakeTB) Helper() {}
+
+func (f *fakeTB) Fatalf(format string, args ...interface{}) {
+	f.failed = true
+	f.msg = fmt.Sprintf(format, args...)
+}
+
+func TestRequireDupeKey(t *testing.T) {
+	dupeErr := mongo.WriteException{
+		WriteErrors: mongo.WriteErrors{
+			{Code: 11000, Message: "E11000 duplicate key error"},
+		},
+	}
+	otherErr := errors.New("boom")
+
+	tests := []struct {
+		name    string
+		require func(testing.TB, error)
+		err     error
+		fail    bool
+	}{
+		{"RequireDupeKey with dupe", testdb.RequireDupeKey, dupeErr, false},
+		{"RequireDupeKey with other", testdb.RequireDupeKey, otherErr, true},
+		{"RequireDupeKey with nil", testdb.RequireDupeKey, nil, true},
+		{"RequireNotDupeKey with dupe", testdb.RequireNotDupeKey, dupeErr, true},
+		{"RequireNotDupeKey with other", testdb.RequireNotDupeKey, otherErr, false},
+		{"RequireNotDupeKey with nil", testdb.RequireNotDupeKey, nil, false},
+	}
+	for _, tc := range tests {
+		tb := &fakeTB{TB: t}
+		tc.require(tb, tc.err)
+		if tb.failed != tc.fail {
+			t.Errorf("%s: got failed=%t, expected %t", tc.name, tb.failed, tc.fail)
+		}
+		if tb.failed && tc.err != nil && !strings.Contains(tb.msg, tc.err.Error()) {
+			t.Errorf("%s: expected the failure message to include the error, got %q", tc.name, tb.msg)
+		}
+	}
+}
+
+func TestAssertUniqueEnforced(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "email", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	}
+	coll, err := testDb.CreateRandomCollection(indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	testdb.AssertUniqueEnforced(t, coll, bson.M{"email": "a@example.com"})
+
+	// Without the index, nothing enforces uniqueness.
+	unindexed, err := testDb.CreateRandomCollection(testdb.NoIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unindexed.Drop(context.Background())
+
+	tb := &fakeTB{TB: t}
+	testdb.AssertUniqueEnforced(tb, unindexed, bson.M{"email": "a@example.com"})
+	if !tb.failed {
+		t.Error("expected the assertion to fail for a collection without a unique index")
+	}
+}
+
+func TestIsolateDatabase(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	var coll *mongo.Collection
+	t.Run("isolated/sub test", func(t *testing.T) {
+		testDb.IsolateDatabase(t)
+
+		var err error
+		coll, err = testDb.CreateRandomCollection(testdb.NoIndexes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := coll.InsertOne(context.Background(), bson.M{"a": 1}); err != nil {
+			t.Fatal(err)
+		}
+
+		name := coll.Database().Name()
+		if !strings.HasPrefix(name, "TestIsolateDatabase_isolated_sub_test_") {
+			t.Errorf("got database %q, expected it to be named after the test", name)
+		}
+	})
+	if coll == nil {
+		t.FailNow()
+	}
+
+	// The database was dropped when the subtest finished.
+	names, err := coll.Database().Client().ListDatabaseNames(context.Background(), bson.M{"name": coll.Database().Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Errorf("expected database %s to be dropped, but it still exists", coll.Database().Name())
+	}
+
+	// And the TestDB went back to its own database.
+	if got := testDb.CurrentDatabase(); got != defaultDb {
+		t.Errorf("got database %q after the subtest, expected %q", got, defaultDb)
+	}
+}
+
+// deadlineTB is a fakeTB with a deadline, like a *testing.T run with -timeout.
+type deadlineTB struct {
+	fakeTB
+	deadline time.Time
+}
+
+func (d *deadlineTB) Deadline() (time.Time, bool) {
+	return d.deadline, true
+}
+
+func TestCreateRandomCollectionT(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	var coll *mongo.Collection
+	t.Run("create", func(t *testing.T) {
+		coll = testDb.CreateRandomCollectionT(t, testdb.NoIndexes)
+		if _, err := coll.InsertOne(context.Background(), bson.M{"a": 1}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if coll == nil {
+		t.FailNow()
+	}
+	if n, err := testDb.CountCollectionsByPrefix(context.Background(), coll.Name()); err != nil || n != 0 {
+		t.Errorf("expected the collection to be dropped after the test, found %d (err: %v)", n, err)
+	}
+}
+
+func TestCreateRandomCollectionTDeadline(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	// The test's deadline has already passed, so setup must not be attempted.
+	tb := &deadlineTB{fakeTB: fakeTB{TB: t}, deadline: time.Now().Add(-time.Millisecond)}
+	if coll := testDb.CreateRandomCollectionT(tb, testdb.NoIndexes); coll != nil {
+		t.Error("expected no collection, got one")
+	}
+	if !tb.failed || !strings.Contains(tb.msg, context.DeadlineExceeded.Error()) {
+		t.Errorf("expected the test to fail with a deadline error, got failed=%t msg=%q", tb.failed, tb.msg)
+	}
+}
+
+func TestCreateRandomCollectionTTimeout(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, time.Nanosecond)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	// The test's deadline is far off, but the TestDB's timeout isn't, and it
+	// still applies.
+	tb := &deadlineTB{fakeTB: fakeTB{TB: t}, deadline: time.Now().Add(time.Hour)}
+	if coll := testDb.CreateRandomCollectionT(tb, testdb.NoIndexes); coll != nil {
+		t.Error("expected no collection, got one")
+	}
+	if !tb.failed || !strings.Contains(tb.msg, context.DeadlineExceeded.Error()) {
+		t.Errorf("expected the test to fail with a deadline error, got failed=%t msg=%q", tb.failed, tb.msg)
+	}
+}
+
+func TestSetup(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	// Registered first so it runs last, after Setup's cleanups have dropped
+	// their collections.
+	t.Cleanup(testDb.Close)
+
+	coll := testDb.Setup(t, testdb.NoIndexes)
+	if !testDb.Connected() {
+		t.Fatal("expected Setup to connect the TestDB")
+	}
+	if _, err := coll.InsertOne(context.Background(), bson.M{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Later calls reuse the connection.
+	if other := testDb.Setup(t, testdb.NoIndexes); other.Name() == coll.Name() {
+		t.Errorf("expected a new collection, got %s again", coll.Name())
+	}
+}
+
+func TestEventually(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	calls := 0
+	err := testdb.Eventually(ctx, time.Millisecond, func() (bool, error) {
+		calls++
+		return calls == 3, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Errorf("got %d calls, expected 3", calls)
+	}
+
+	// An error from fn stops polling.
+	fnErr := errors.New("boom")
+	calls = 0
+	err = testdb.Eventually(ctx, time.Millisecond, func() (bool, error) {
+		calls++
+		return false, fnErr
+	})
+	if err != fnErr || calls != 1 {
+		t.Errorf("got err=%v after %d calls, expected %v after 1", err, calls, fnErr)
+	}
+
+	// So does ctx expiring.
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer shortCancel()
+	err = testdb.Eventually(shortCtx, time.Millisecond, func() (bool, error) { return false, nil })
+	if err != context.DeadlineExceeded {
+		t.Errorf("got err=%v, expected %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestShared(t *testing.T) {
+	defer testdb.ShutdownShared()
+
+	var wg sync.WaitGroup
+	got := make([]*testdb.TestDB, 4)
+	for i := range got {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			testDb, err := testdb.Shared(defaultUrl, defaultDb, defaultTimeout)
+			if err != nil {
+				t.Error(err)
+			}
+			got[i] = testDb
+		}(i)
+	}
+	wg.Wait()
+	for _, testDb := range got[1:] {
+		if testDb != got[0] {
+			t.Fatal("expected every caller to get the same TestDB")
+		}
+	}
+
+	if err := testdb.ShutdownShared(); err != nil {
+		t.Fatal(err)
+	}
+	testDb, err := testdb.Shared(defaultUrl, defaultDb, defaultTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if testDb == got[0] {
+		t.Error("expected a new TestDB after ShutdownShared")
+	}
+}
+
+func TestAssertDocEqual(t *testing.T) {
+	want := bson.M{"name": "a", "n": 1, "meta": bson.M{"tag": "x"}}
+	got := bson.M{
+		"_id":  "generated",
+		"name": "a",
+		"n":    int32(1),
+		"meta": bson.M{"tag": "x", "version": int32(3)},
+	}
+	testdb.AssertDocEqual(t, got, want, "_id", "meta.version")
+
+	tb := &fakeTB{TB: t}
+	got = bson.M{"name": "b", "extra": true}
+	testdb.AssertDocEqual(tb, got, want)
+	if !tb.failed {
+		t.Fatal("expected the assertion to fail for different documents")
+	}
+	for _, field := range []string{"name:", "n: missing", "meta: missing", "extra:"} {
+		if !strings.Contains(tb.msg, field) {
+			t.Errorf("expected the failure message to mention %q, got %q", field, tb.msg)
+		}
+	}
+}
+
+func TestAssertDocEqualEmbeddedMaps(t *testing.T) {
+	// Maps marshal in a random order, so compare them many times to be sure
+	// the order isn't what's being compared.
+	for i := 0; i < 200; i++ {
+		want := bson.M{"meta": bson.M{"a": 1, "b": 2, "c": 3, "d": bson.M{"e": 4, "f": 5}}}
+		got := bson.M{"meta": bson.M{"d": bson.M{"f": 5, "e": 4}, "c": 3, "b": 2, "a": 1}}
+		tb := &fakeTB{TB: t}
+		testdb.AssertDocEqual(tb, got, want)
+		if tb.failed {
+			t.Fatalf("run %d: expected equal documents to pass, got %q", i, tb.msg)
+		}
+	}
+}
+
+func TestAssertDocEqualEmbeddedOrder(t *testing.T) {
+	want := bson.M{"meta": bson.D{{Key: "a", Value: 1}, {Key: "b", Value: bson.D{{Key: "c", Value: 2}, {Key: "d", Value: 3}}}}}
+	got := bson.M{"meta": bson.D{{Key: "b", Value: bson.D{{Key: "d", Value: 3}, {Key: "c", Value: 2}}}, {Key: "a", Value: 1}}}
+	tb := &fakeTB{TB: t}
+	testdb.AssertDocEqual(tb, got, want)
+	if tb.failed {
+		t.Errorf("expected fields in a different order to be equal, got %q", tb.msg)
+	}
+
+	// Arrays are still ordered.
+	tb = &fakeTB{TB: t}
+	testdb.AssertDocEqual(tb, bson.M{"tags": bson.A{"x", "y"}}, bson.M{"tags": bson.A{"y", "x"}})
+	if !tb.failed {
+		t.Error("expected arrays in a different order to differ")
+	}
+}
+
+func TestAssertCollectionScan(t *testing.T) {
+	testDb := testdb.NewTestDB(defaultUrl, defaultDb, defaultTimeout)
+	if err := testDb.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer testDb.Close()
+
+	coll, err := testDb.CreateRandomCollection([]mongo.IndexModel{
+		testdb.NamedIndex("by_color", bson.D{{Key: "color", Value: 1}}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coll.Drop(context.Background())
+
+	testdb.AssertCollectionScan(t, coll, bson.M{"shape": "square"})
+
+	tb := &fakeTB{TB: t}
+	testdb.AssertCollectionScan(tb, coll, bson.M{"color": "red"})
+	if !tb.failed {
+		t.Fatal("expected the assertion to fail for an indexed query")
+	}
+	if !strings.Contains(tb.msg, "IXSCAN") {
+		t.Errorf("expected the failure message to include the actual stages, got %q", tb.msg)
+	}
+}
+
+func TestWinningPlanStages(t *testing.T) {
+	collScan := bson.M{"stage": "COLLSCAN"}
+	ixScan := bson.M{"stage": "FETCH", "inputStage": bson.M{"stage": "IXSCAN"}}
+
+	got, err := testdb.WinningPlanStages(bson.M{"winningPlan": collScan})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string][]string{"": {"COLLSCAN"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, expected %v", got, want)
+	}
+
+	// On a sharded cluster, each shard has its own plan, nested under the
+	// merging stage.
+	sharded := bson.M{"winningPlan": bson.M{
+		"stage": "SHARD_MERGE",
+		"shards": bson.A{
+			bson.M{"shardName": "rs0", "winningPlan": collScan},
+			bson.M{"shardName": "rs1", "winningPlan": bson.M{"queryPlan": ixScan}},
+		},
+	}}
+	got, err = testdb.WinningPlanStages(sharded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{"rs0": {"COLLSCAN"}, "rs1": {"FETCH", "IXSCAN"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, expected %v", got, want)
+	}
+
+	for _, planner := range []bson.M{
+		{},
+		{"winningPlan": bson.M{"shards": bson.A{}}},
+		{"winningPlan": bson.M{"unknown": true}},
+	} {
+		if _, err := testdb.WinningPlanStages(planner); err == nil || !strings.Contains(err.Error(), "unsupported explain layout") {
+			t.Errorf("%v: got error %v, expected an unsupported layout", planner, err)
+		}
+	}
+}